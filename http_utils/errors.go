@@ -0,0 +1,79 @@
+package http_utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// Maximum number of bytes of an error body retained in a GitHubError.
+const kMaxErrorBodyBytes = 4096
+
+// Secrets that an error body may echo back, e.g. a token quoted in a validation error:
+// github tokens by their prefixes, the credentials of Authorization headers, and token
+// looking credentials of the Authorization schemes, e.g. "Bearer <token>". The schemes are
+// case sensitive and their credentials long, so that prose such as "token expired" is
+// left alone.
+var kSecretPatterns = regexp.MustCompile(
+	`\b(gh[pousr]_[A-Za-z0-9]{16,}|github_pat_[A-Za-z0-9_]{16,})` +
+		`|\b(Bearer|token)\s+[A-Za-z0-9_\-.=+/]{20,}` +
+		`|(?i:\b(authorization:\s*(?:basic|bearer|token)))\s+[A-Za-z0-9_\-.=+/]+`)
+
+// Returns body with the secrets it may hold redacted, truncated to kMaxErrorBodyBytes. The
+// whole body is redacted before it is truncated, since a secret cut short by the truncation
+// might no longer match kSecretPatterns.
+func redactErrorBody(body []byte) []byte {
+	redacted := kSecretPatterns.ReplaceAllFunc(body, func(match []byte) []byte {
+		sub := kSecretPatterns.FindSubmatch(match)
+		// Keep the scheme, only the credential is secret.
+		for _, scheme := range sub[2:] {
+			if len(scheme) > 0 {
+				return append(append([]byte{}, scheme...), " [REDACTED]"...)
+			}
+		}
+		return []byte("[REDACTED]")
+	})
+	if len(redacted) > kMaxErrorBodyBytes {
+		// Cap the capacity too, so that the marker never overwrites the rest of body.
+		redacted = redacted[:kMaxErrorBodyBytes:kMaxErrorBodyBytes]
+		redacted = append(redacted, "...(truncated)"...)
+	}
+	return redacted
+}
+
+// Error returned when github responds with an error status, carrying the fields needed to
+// branch on the failure and to log it.
+type GitHubError struct {
+	// Status code of github's response.
+	StatusCode int
+	// Message from github's JSON error body, or the status text if there was none.
+	Message string
+	// URL of the failed request.
+	URL string
+	// Value of github's X-GitHub-Request-Id header, to be quoted to github support.
+	RequestID string
+	// Raw body of github's response for debugging, truncated to kMaxErrorBodyBytes and with
+	// the secrets it may echo redacted.
+	Body []byte
+}
+
+func (e *GitHubError) Error() string {
+	return fmt.Sprintf("github returned %d for %s: %s (request id %s)", e.StatusCode, e.URL,
+		e.Message, e.RequestID)
+}
+
+// Returns a GitHubError populated from an error response and its body.
+func newGitHubError(resp *http.Response, body []byte, url string) *GitHubError {
+	e := &GitHubError{StatusCode: resp.StatusCode, URL: url,
+		RequestID: resp.Header.Get("X-GitHub-Request-Id"), Body: redactErrorBody(body)}
+	var ghBody struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &ghBody) == nil && ghBody.Message != "" {
+		e.Message = ghBody.Message
+	} else {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
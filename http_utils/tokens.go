@@ -0,0 +1,78 @@
+package http_utils
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+// Error returned by TokenPool.Next once github rejected all the tokens of the pool.
+var ErrNoActiveTokens = errors.New("all api tokens were rejected by github and disabled")
+
+// Pool of api tokens that requests to github rotate through, spreading them across the
+// tokens' rate limits. Tokens that github rejects with a 401 are disabled for the rest of
+// the process' lifetime, so that a single bad credential doesn't fail every Nth request.
+type TokenPool struct {
+	lock     sync.Mutex
+	tokens   []string
+	disabled map[string]bool
+	// Index in tokens of the next token to hand out.
+	next int
+}
+
+// Creates a new TokenPool from tokens, ignoring empty ones. A nil or empty pool hands out
+// no tokens, i.e. requests are sent unauthenticated.
+func NewTokenPool(tokens []string) *TokenPool {
+	p := &TokenPool{disabled: make(map[string]bool)}
+	for _, t := range tokens {
+		if t != "" {
+			p.tokens = append(p.tokens, t)
+		}
+	}
+	return p
+}
+
+// Returns the next active token in rotation, or "" if the pool is empty, in which case
+// requests are sent unauthenticated. Returns ErrNoActiveTokens if all the tokens are
+// disabled, rather than silently falling back to unauthenticated requests.
+func (p *TokenPool) Next() (string, error) {
+	if p == nil || len(p.tokens) == 0 {
+		return "", nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for ii := 0; ii < len(p.tokens); ii++ {
+		t := p.tokens[p.next]
+		p.next = (p.next + 1) % len(p.tokens)
+		if !p.disabled[t] {
+			return t, nil
+		}
+	}
+	return "", ErrNoActiveTokens
+}
+
+// Disables a token that github rejected.
+func (p *TokenPool) Disable(token string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.disabled[token] {
+		return
+	}
+	p.disabled[token] = true
+	// Never log the token itself, only its position in the pool.
+	for ii, t := range p.tokens {
+		if t == token {
+			log.Printf("Disabling api token #%v after github rejected it with a 401", ii)
+		}
+	}
+}
+
+// Returns the number of active and disabled tokens.
+func (p *TokenPool) Counts() (active int, disabled int) {
+	if p == nil {
+		return 0, 0
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.tokens) - len(p.disabled), len(p.disabled)
+}
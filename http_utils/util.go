@@ -1,85 +1,610 @@
 package http_utils
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// Base URL of the github API that all requests are issued against.
+const BaseURL = "https://api.github.com"
+
+// Overall deadline of every request to github by the default client, body included, so
+// that a hung connection can't block a refresh forever when no refresh timeout is set.
+const DefaultClientTimeout = 30 * time.Second
+
+// Maximum number of idle connections to github kept open for reuse. Refreshes and the proxy
+// all hit the same host, far more often than http.DefaultTransport's 2 per host allow for.
+const kMaxIdleConns = 64
+
+// Returns the default client used for requests to github: a pooling transport honoring the
+// HTTP_PROXY/HTTPS_PROXY env variables, with DefaultClientTimeout.
+func newDefaultClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = kMaxIdleConns
+	transport.MaxIdleConnsPerHost = kMaxIdleConns
+	return &http.Client{Transport: transport, Timeout: DefaultClientTimeout}
+}
+
+// Client used for all requests to github.
+var client = newDefaultClient()
+
+// Whether client was set with SetClient, rather than being the default one.
+var clientSet bool
+
+// Sets the client used for all requests to github, e.g. to route them through a custom
+// http.RoundTripper. Its own Timeout applies, SetClientTimeout leaves it alone. It must be
+// called before any request is issued.
+func SetClient(c *http.Client) {
+	client = c
+	clientSet = true
+}
+
+// Sets the overall deadline of every request to github issued with the default client,
+// body included, on top of the refresh and proxy timeouts. 0 keeps DefaultClientTimeout,
+// and a client set with SetClient keeps its own. It must be called before any request is
+// issued.
+func SetClientTimeout(timeout time.Duration) {
+	if clientSet || timeout <= 0 {
+		return
+	}
+	c := *client
+	c.Timeout = timeout
+	client = &c
+}
+
+// Value of the X-GitHub-Api-Version header sent with every request, empty to not send it
+// and get github's default version.
+var apiVersion string
+
+// Sets the github API version requested by all requests to github. It must be called
+// before any request is issued.
+func SetAPIVersion(version string) {
+	apiVersion = version
+}
+
+// Deadlines of the requests issued by PagedGet and by Forward respectively, 0 for none.
+var refreshTimeout, proxyTimeout time.Duration
+
+// Sets the deadlines of the requests issued by PagedGet, which serve background refreshes,
+// and of those issued by Forward, which serve live clients and usually warrant a tighter
+// deadline. A zero timeout means no deadline. It must be called before any request is
+// issued.
+func SetTimeouts(refresh time.Duration, proxy time.Duration) {
+	refreshTimeout = refresh
+	proxyTimeout = proxy
+}
+
+// Semaphore capping the number of requests issued by all PagedGets concurrently, nil if
+// unlimited.
+var requestSlots chan struct{}
+
+// Caps the number of requests to github issued concurrently by all PagedGets, and thus by
+// all refreshes together, so that they stay within a connection budget. 0 means unlimited.
+// Requests proxied by Forward serve live clients and aren't capped. It must be called
+// before any request is issued.
+func SetMaxConcurrentRequests(n int) {
+	requestSlots = nil
+	if n > 0 {
+		requestSlots = make(chan struct{}, n)
+	}
+}
+
+// Function replying the errors of Forward, e.g. a 502 if github can't be reached.
+var writeError = http.Error
+
+// Sets the function replying the errors of Forward, which defaults to http.Error, e.g. to
+// reply them in the same format as the caller's own errors. It must be called before any
+// request is issued.
+func SetErrorWriter(f func(w http.ResponseWriter, message string, status int)) {
+	writeError = f
+}
+
+// Maximum time a PagedGet waits for a rate limit to reset before retrying, 0 to never wait
+// and fail right away.
+var maxRateLimitWait time.Duration
+
+// Number of times a PagedGet retries a rate limited request before failing.
+const kRateLimitRetries = 3
+
+// Sets the maximum time a PagedGet waits for github's rate limit to reset, as advertised by
+// the X-RateLimit-Reset or Retry-After header of a rate limited response, before retrying.
+// Longer waits are cut to it. 0 disables waiting, failing rate limited requests right away.
+// It must be called before any request is issued.
+func SetMaxRateLimitWait(wait time.Duration) {
+	maxRateLimitWait = wait
+}
+
+// Headers of github's responses relayed by Forward by default.
+var DefaultForwardedHeaders = []string{"Content-Type", "Link", "X-RateLimit-*"}
+
+// Headers of github's responses relayed by Forward, and those never relayed even if they
+// are in forwardedHeaders. A trailing * matches any suffix.
+var forwardedHeaders, hiddenHeaders = DefaultForwardedHeaders, []string(nil)
+
+// Hop-by-hop headers, which only apply to a single connection and are never relayed.
+var kHopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// Sets the headers of github's responses relayed by Forward, and those never relayed even
+// if they are in forwarded, e.g. {"*"} and {"X-RateLimit-*"} to relay all headers but the
+// rate limit ones. A trailing * matches any suffix, and names are case insensitive.
+// Hop-by-hop headers are never relayed. It must be called before any request is issued.
+func SetForwardedHeaders(forwarded []string, hidden []string) {
+	forwardedHeaders = forwarded
+	hiddenHeaders = hidden
+}
+
+// Returns whether the header name matches any of patterns.
+func matchesHeader(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Copies the headers of resp that are to be relayed to h.
+func copyForwardedHeaders(h http.Header, resp *http.Response) {
+	hopByHop := kHopByHopHeaders
+	// Connection may list further hop-by-hop headers.
+	for _, v := range resp.Header.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			hopByHop = append(hopByHop, strings.TrimSpace(name))
+		}
+	}
+	for name, values := range resp.Header {
+		// The body is relayed as is, so its encoding must be too.
+		relayed := name == "Content-Encoding" ||
+			(matchesHeader(name, forwardedHeaders) && !matchesHeader(name, hiddenHeaders))
+		if relayed && !matchesHeader(name, hopByHop) {
+			h[name] = values
+		}
+	}
+}
+
+// Returns a context derived from parent with the given deadline, or without any if
+// timeout is 0.
+func timeoutContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(parent, timeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// Policy of the retries of transient failures by a PagedGet, i.e. network errors and 502,
+// 503 and 504 responses.
+type RetryPolicy struct {
+	// Maximum number of attempts of each request, including the first. 0 or 1 never
+	// retries.
+	MaxAttempts int
+	// Delay before the first retry, doubled for every further retry, with jitter.
+	BaseDelay time.Duration
+}
+
+// Returns the delay before the given retry, 1 for the first one: between half and all of
+// BaseDelay*2^(retry-1), so that concurrent refreshes don't retry in lockstep.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	backoff := p.BaseDelay << (retry - 1)
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// Returns whether a request that got resp and err is worth retrying, i.e. it failed on the
+// network or github is temporarily unavailable.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusBadGateway ||
+		resp.StatusCode == http.StatusServiceUnavailable ||
+		resp.StatusCode == http.StatusGatewayTimeout
+}
+
+// Issues req, retrying transient failures as per policy, as long as ctx isn't done. The
+// response of the last attempt is returned, e.g. a 503 once the attempts are exhausted.
+// req must have no body, so that it can be sent again.
+func doWithRetries(ctx context.Context, policy RetryPolicy, req *http.Request) (
+	*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Do(req)
+		if attempt >= policy.MaxAttempts || ctx.Err() != nil || !retryable(resp, err) {
+			return resp, err
+		}
+		if err != nil {
+			log.Printf("Retrying GET %v after attempt %v failed, err=%v", req.URL, attempt, err)
+		} else {
+			log.Printf("Retrying GET %v after attempt %v got %v", req.URL, attempt,
+				resp.StatusCode)
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(policy.delay(attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
 // Helper struct that aids in paged gets by keeping track of the next link.
 type PagedGet struct {
 	nextLink string
-	authHdr  string
+	tokens   *TokenPool
+	retry    RetryPolicy
+	// Page number of the last page as advertised by the rel="last" link, 0 if unknown.
+	lastPage int
+	// Value of the X-RateLimit-Remaining header on the latest response, -1 if unknown.
+	rateLimitRemaining int
+	// Time of the X-RateLimit-Reset header on the latest response, zero if unknown.
+	rateLimitReset time.Time
+	// Value of the Retry-After header on the latest response, 0 if it had none.
+	retryAfter time.Duration
+	// Status code of the latest response.
+	statusCode int
+	// API version github served the latest response with, empty if unknown.
+	apiVersion string
+}
+
+// Creates a new PagedGet struct. Requests are authenticated with tokens rotated through
+// tokens, which may be nil to send them unauthenticated, and their transient failures are
+// retried as per retry.
+func NewPagedGet(path string, tokens *TokenPool, retry RetryPolicy) *PagedGet {
+	return &PagedGet{nextLink: fmt.Sprintf("%s%s", BaseURL, path), tokens: tokens,
+		retry: retry, rateLimitRemaining: -1}
 }
 
-// Creates a new PagedGet struct.
-func NewPagedGet(path string, apiToken string) *PagedGet {
-	var authHdr string
-	if apiToken != "" {
-		authHdr = fmt.Sprintf("token %s", apiToken)
+// Returns the page number of the last page advertised by github, or 0 if the latest
+// response didn't advertise one (e.g. because it was the only page).
+func (g *PagedGet) LastPage() int {
+	return g.lastPage
+}
+
+// Returns the status code of the latest response, e.g. 451 for a repo that is unavailable
+// for legal reasons.
+func (g *PagedGet) StatusCode() int {
+	return g.statusCode
+}
+
+// Returns the github API version the latest response was served with, as reported by
+// github or else as requested, empty if neither is known.
+func (g *PagedGet) APIVersion() string {
+	return g.apiVersion
+}
+
+// Returns the number of requests remaining in the current rate limit window as reported
+// by the latest response, or -1 if unknown.
+func (g *PagedGet) RateLimitRemaining() int {
+	return g.rateLimitRemaining
+}
+
+// Returns the time at which the current rate limit window resets as reported by the latest
+// response, or the zero time if unknown.
+func (g *PagedGet) RateLimitReset() time.Time {
+	return g.rateLimitReset
+}
+
+// Returns whether the latest response, which failed with err, was rate limited by github,
+// i.e. a 403 or 429 with no requests remaining or with a Retry-After header.
+func (g *PagedGet) rateLimited(err error) bool {
+	ghErr, ok := err.(*GitHubError)
+	if !ok || (ghErr.StatusCode != http.StatusForbidden &&
+		ghErr.StatusCode != http.StatusTooManyRequests) {
+		return false
+	}
+	return g.rateLimitRemaining == 0 || g.retryAfter > 0
+}
+
+// Returns how long to wait at now before retrying a rate limited request, per the
+// Retry-After header of the latest response or else its X-RateLimit-Reset, capped to
+// maxRateLimitWait.
+func (g *PagedGet) rateLimitDelay(now time.Time) time.Duration {
+	delay := g.retryAfter
+	if delay == 0 && !g.rateLimitReset.IsZero() {
+		delay = g.rateLimitReset.Sub(now)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return min(delay, maxRateLimitWait)
+}
+
+// Gets next page and whether there are more pages remaining. Network errors and 502, 503
+// and 504 responses are retried with exponential backoff as per the PagedGet's
+// RetryPolicy, within the refresh timeout. If github responds with an error status, a
+// *GitHubError is returned instead. A rate limited request is retried once
+// the rate limit resets, waiting at most the time set by SetMaxRateLimitWait, a few times
+// before failing. If ctx is canceled or the page isn't fetched within the refresh timeout,
+// the context's error is returned, and network failures are returned as errors too, so that
+// the caller keeps its stale cache.
+func (g *PagedGet) GetPage(ctx context.Context) ([]byte, bool, error) {
+	for retries := 0; ; retries++ {
+		body, more, err := g.getPageOnce(ctx)
+		if maxRateLimitWait <= 0 || retries == kRateLimitRetries || !g.rateLimited(err) {
+			return body, more, err
+		}
+		delay := g.rateLimitDelay(time.Now())
+		log.Printf("Rate limited on %v, remaining=%v reset=%v, retrying in %v", g.nextLink,
+			g.rateLimitRemaining, g.rateLimitReset.Format(time.RFC3339), delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, false, fmt.Errorf("GET %v: %w", g.nextLink, ctx.Err())
+		}
 	}
-	return &PagedGet{nextLink: fmt.Sprintf("https://api.github.com%s", path), authHdr:authHdr}
 }
 
-// Gets next page and whether there are more pages remaining.
-func (g *PagedGet) GetPage() ([]byte, bool) {
+// Gets next page and whether there are more pages remaining, with a single attempt.
+func (g *PagedGet) getPageOnce(ctx context.Context) ([]byte, bool, error) {
 	// We don't expect to be called if nextLink is empty.
 	if g.nextLink == "" {
-		log.Panicf("GetPage beyond page chain.")
-	}
-	req, err := http.NewRequest("GET", g.nextLink, nil)
-	if err != nil {
-		log.Panicf("Get request failed %v", err.Error())
+		return nil, false, fmt.Errorf("GetPage beyond page chain")
 	}
-	req.Header.Add("Accept", "application/vnd.github.v3+json")
-	// Add api token if needed.
-	if g.authHdr != "" {
-		req.Header.Add("Authorization", g.authHdr)
+	// Wait for a request slot, which the refresh timeout doesn't apply to.
+	if requestSlots != nil {
+		select {
+		case requestSlots <- struct{}{}:
+			defer func() { <-requestSlots }()
+		case <-ctx.Done():
+			return nil, false, fmt.Errorf("GET %v: %w", g.nextLink, ctx.Err())
+		}
 	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Panicf("Failed to issue http GET on url=%v, err=%v", g.nextLink, err.Error())
+	ctx, cancel := timeoutContext(ctx, refreshTimeout)
+	defer cancel()
+	var resp *http.Response
+	for {
+		token, err := g.tokens.Next()
+		if err != nil {
+			return nil, false, fmt.Errorf("GET %v: %w", g.nextLink, err)
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", g.nextLink, nil)
+		if err != nil {
+			return nil, false, fmt.Errorf("GET %v: %w", g.nextLink, err)
+		}
+		req.Header.Add("Accept", "application/vnd.github.v3+json")
+		if apiVersion != "" {
+			req.Header.Add("X-GitHub-Api-Version", apiVersion)
+		}
+		// Add api token if needed.
+		if token != "" {
+			req.Header.Add("Authorization", fmt.Sprintf("token %s", token))
+		}
+		resp, err = doWithRetries(ctx, g.retry, req)
+		if err != nil && ctx.Err() != nil {
+			return nil, false, fmt.Errorf("GET %v: %w", g.nextLink, ctx.Err())
+		} else if err != nil {
+			return nil, false, fmt.Errorf("GET %v: %w", g.nextLink, err)
+		}
+		// Disable a rejected token and retry with the next one, if any.
+		if resp.StatusCode == http.StatusUnauthorized && token != "" {
+			g.tokens.Disable(token)
+			if active, _ := g.tokens.Counts(); active > 0 {
+				resp.Body.Close()
+				continue
+			}
+		}
+		break
 	}
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	g.statusCode = resp.StatusCode
+	body, _ := ioutil.ReadAll(resp.Body)
+	if ctx.Err() != nil {
+		return nil, false, fmt.Errorf("GET %v: %w", g.nextLink, ctx.Err())
+	}
+	g.apiVersion = resp.Header.Get("X-GitHub-Api-Version-Selected")
+	if g.apiVersion == "" {
+		g.apiVersion = apiVersion
+	}
+	g.rateLimitRemaining, g.rateLimitReset = -1, time.Time{}
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		g.rateLimitRemaining = remaining
+	}
+	if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		g.rateLimitReset = time.Unix(reset, 0)
+	}
+	g.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if resp.StatusCode >= 400 {
+		return nil, false, newGitHubError(resp, body, g.nextLink)
+	}
 	linksRelStr := resp.Header.Get("Link")
 	// If link header is missing, then this url has only a single page.
 	if linksRelStr == "" {
-		return body, false
+		return body, false, nil
 	}
-	// Search for link to next page.
+	// Search for links to the next and last pages.
+	more := false
 	linkRels := strings.Split(linksRelStr, ",")
 	for _, lr := range linkRels {
 		l:= strings.Split(lr, ";")
+		// Skip malformed links without a rel.
+		if len(l) < 2 {
+			log.Printf("Skipping malformed link %q of %v", lr, g.nextLink)
+			continue
+		}
+		link := strings.TrimSpace(l[0])
+		link = strings.TrimPrefix(link, "<")
+		link = strings.TrimSuffix(link, ">")
+		rel := strings.TrimSpace(l[1])
 		// If next page link is found, return true to indicate to caller that GetPage
 		// needs to be called again.
-		if strings.TrimSpace(l[1]) == "rel=\"next\"" {
-			g.nextLink = strings.TrimSpace(l[0])
-			g.nextLink = strings.TrimPrefix(g.nextLink, "<")
-			g.nextLink = strings.TrimSuffix(g.nextLink, ">")
-			return body, true
+		if rel == "rel=\"next\"" {
+			// A page linking to itself as the next page would make callers loop forever.
+			if link == g.nextLink {
+				log.Printf("Page %v links to itself as the next page, stopping there", link)
+				continue
+			}
+			g.nextLink = link
+			more = true
+		} else if rel == "rel=\"last\"" {
+			g.lastPage = pageNumber(link)
 		}
 	}
-	// This is the last page.
-	return body, false
+	return body, more, nil
+}
+
+// Returns the delay advertised by a Retry-After header at now, given either in seconds or
+// as an HTTP date, or 0 if the header is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
 }
 
-func Forward(w http.ResponseWriter, r *http.Request) {
-	url := fmt.Sprintf("https://api.github.com%s", r.URL)
-	log.Printf("Forwarding %v", url)
-	req, err := http.NewRequest("GET", url, r.Body)
+// Returns the value of the page query parameter of link, or 0 if it has none.
+func pageNumber(link string) int {
+	u, err := url.Parse(link)
 	if err != nil {
-		log.Panicf("Get request failed %v", err.Error())
+		return 0
+	}
+	page, _ := strconv.Atoi(u.Query().Get("page"))
+	return page
+}
+
+// Headers of a 304 from github that are relayed to the client.
+var kNotModifiedHeaders = []string{"ETag", "Last-Modified", "Cache-Control", "Expires", "Vary"}
+
+// Media type requested from github for all JSON responses.
+const kGitHubJSON = "application/vnd.github+json"
+
+// Returns an error if u has no path to forward to github, e.g. an empty or whitespace only
+// one, or one with control characters.
+func validateForwardPath(u *url.URL) error {
+	if strings.TrimSpace(u.Path) == "" || !strings.HasPrefix(u.Path, "/") {
+		return fmt.Errorf("invalid path %q to forward", u.Path)
+	}
+	for _, c := range u.Path {
+		if c < ' ' || c == 0x7f {
+			return fmt.Errorf("invalid path %q to forward, has control characters", u.Path)
+		}
+	}
+	return nil
+}
+
+// Proxies a request to github, relaying github's response along with the headers set by
+// SetForwardedHeaders. If github responds with an error status, the response is still
+// relayed and a *GitHubError is returned so that the caller can log it. If forceJSON is
+// set, the client's Accept header is replaced with the github JSON media type, otherwise
+// it is passed through as is. If github doesn't respond within the proxy timeout or the
+// client timeout, a 504 is written and the timeout error is returned, and if github can't
+// be reached, a 502 Bad Gateway is. Requests with an invalid path get a 400 and are never
+// sent to github. The request to github is canceled if the client goes away, in which case
+// nothing is written.
+func Forward(w http.ResponseWriter, r *http.Request, forceJSON bool) error {
+	if err := validateForwardPath(r.URL); err != nil {
+		writeError(w, "Invalid path", http.StatusBadRequest)
+		return err
 	}
-	req.Header = r.Header
-	resp, err := http.DefaultClient.Do(req)
+	// Only the path and query are forwarded, so that a request in absolute form can't
+	// point the upstream URL away from github.
+	url := fmt.Sprintf("%s%s", BaseURL, r.URL.RequestURI())
+	slog.Debug(fmt.Sprintf("Forwarding %v", url))
+	ctx, cancel := timeoutContext(r.Context(), proxyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, r.Body)
 	if err != nil {
-		log.Panicf("Failed to issue http GET on url=%v, err=%v", url, err.Error())
+		writeError(w, "Invalid path", http.StatusBadRequest)
+		return fmt.Errorf("GET %v: %w", url, err)
+	}
+	// Clone so that the client's request isn't modified.
+	req.Header = r.Header.Clone()
+	if forceJSON {
+		req.Header.Set("Accept", kGitHubJSON)
+	}
+	// Request the configured API version unless the client asked for one.
+	if apiVersion != "" && req.Header.Get("X-GitHub-Api-Version") == "" {
+		req.Header.Set("X-GitHub-Api-Version", apiVersion)
+	}
+	resp, err := client.Do(req)
+	if err != nil && r.Context().Err() != nil {
+		return fmt.Errorf("GET %v: client went away: %w", url, r.Context().Err())
+	} else if err != nil && ctx.Err() != nil {
+		writeError(w, "Timed out waiting for github", http.StatusGatewayTimeout)
+		return fmt.Errorf("GET %v: %w", url, ctx.Err())
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		// The client's own timeout.
+		writeError(w, "Timed out waiting for github", http.StatusGatewayTimeout)
+		return fmt.Errorf("GET %v: %w", url, err)
+	} else if err != nil {
+		writeError(w, "Failed to reach github", http.StatusBadGateway)
+		return fmt.Errorf("GET %v: %w", url, err)
 	}
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	//w.Header() = resp.Header
-	w.Write(body)
+	copyForwardedHeaders(w.Header(), resp)
+	// Relay a 304 to a conditional request as is, without any body, along with the
+	// validators the client revalidates its copy against.
+	if resp.StatusCode == http.StatusNotModified {
+		for _, h := range kNotModifiedHeaders {
+			if v := resp.Header.Get(h); v != "" {
+				w.Header().Set(h, v)
+			}
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	// Relay the upstream status, so that e.g. a 451 for a repo that is unavailable for
+	// legal reasons isn't turned into a 200. Error bodies are small and read whole, for the
+	// returned error.
+	if resp.StatusCode >= 400 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		if r.Context().Err() != nil {
+			return fmt.Errorf("GET %v: client went away: %w", url, r.Context().Err())
+		} else if ctx.Err() != nil {
+			writeError(w, "Timed out waiting for github", http.StatusGatewayTimeout)
+			return fmt.Errorf("GET %v: %w", url, ctx.Err())
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+		return newGitHubError(resp, body, url)
+	}
+	// Stream other bodies. Once the status is sent, a timeout can only cut the body short.
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("GET %v: relaying body: %w", url, err)
+	}
+	return nil
+}
+
+// Decodes the items of a page into v, which must point to a slice. Most github list
+// endpoints return a bare JSON array, but some (e.g. search) wrap it in an object as
+// {"items": [...]}. Both shapes are accepted.
+func DecodeItems(body []byte, v interface{}) error {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		var wrapped struct {
+			Items json.RawMessage `json:"items"`
+		}
+		if err := json.Unmarshal(trimmed, &wrapped); err != nil {
+			return err
+		}
+		if wrapped.Items == nil {
+			return fmt.Errorf("object page has no items field")
+		}
+		trimmed = wrapped.Items
+	}
+	return json.Unmarshal(trimmed, v)
 }
@@ -2,25 +2,228 @@ package main
 
 import (
 	"api-cache/server"
+	"flag"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// Parses the value of a flag holding comma separated path=duration entries into durations.
+func parsePathDurations(name string, value string, durations map[string]time.Duration) {
+	if value == "" {
+		return
+	}
+	for _, kv := range strings.Split(value, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			log.Panicf("Invalid -%s entry %s", name, kv)
+		}
+		d, e := time.ParseDuration(parts[1])
+		if e != nil || d <= 0 {
+			log.Panicf("Invalid duration in -%s entry %s", name, kv)
+		}
+		durations[parts[0]] = d
+	}
+}
+
 func main() {
+	config := server.DefaultConfig()
+	flag.DurationVar(&config.RefreshInterval, "refresh-interval", config.RefreshInterval,
+		"Interval at which the caches are refreshed")
+	refreshIntervals := flag.String("refresh-intervals", "",
+		"Comma separated per path refresh intervals, e.g. /orgs/Netflix/members=1h,/=24h")
+	org := flag.String("org", "",
+		"Github org whose data is cached, defaults to $GITHUB_ORG or else "+server.DefaultOrg)
+	extraCachedPaths := flag.String("cached-paths", "",
+		"Comma separated additional github paths to cache, e.g. /meta")
+	proxyResponseHeaders := flag.String("proxy-response-headers",
+		strings.Join(config.ProxyResponseHeaders, ","),
+		"Comma separated github response headers relayed by the proxy, * matching any suffix")
+	viewMetrics := flag.String("view-metrics", "",
+		"Comma separated metrics whose views are precomputed and served, e.g. stars,forks, empty for all")
+	proxyHiddenHeaders := flag.String("proxy-hidden-headers", "",
+		"Comma separated github response headers never relayed by the proxy, e.g. X-RateLimit-*")
+	cacheTTLs := flag.String("cache-ttls", "",
+		"Comma separated per path TTLs after which a requested cache is refreshed, e.g. /orgs/Netflix/repos=1m")
+	flag.IntVar(&config.EmptyViewStatus, "empty-view-status", config.EmptyViewStatus,
+		"Status code for views with no results: 200 (empty JSON array) or 204 (no content)")
+	flag.IntVar(&config.MaxConcurrentRequests, "max-concurrent-requests",
+		config.MaxConcurrentRequests, "Maximum number of requests served concurrently, 0 for unlimited")
+	flag.BoolVar(&config.ExcludeArchived, "exclude-archived", config.ExcludeArchived,
+		"Drop archived and disabled repos from the cached repos list")
+	flag.IntVar(&config.ContributorsTopK, "contributors-top-k", config.ContributorsTopK,
+		"Number of top repos by stars to fetch contributor counts for, 0 to disable")
+	flag.StringVar(&config.UnixSocket, "unix-socket", config.UnixSocket,
+		"Path of a unix domain socket to serve on in addition to the TCP port")
+	flag.BoolVar(&config.ValidateJSON, "validate-json", config.ValidateJSON,
+		"Reject bodies fetched from github that aren't valid JSON, keeping the stale cache")
+	flag.IntVar(&config.MetricsTopK, "metrics-top-k", config.MetricsTopK,
+		"Number of top repos by stars and by forks exported as gauges on /metrics")
+	flag.IntVar(&config.CompressMinBytes, "compress-min-bytes", config.CompressMinBytes,
+		"Minimum response size to gzip for clients accepting it, negative to disable")
+	flag.IntVar(&config.WatchdogIntervals, "watchdog-intervals", config.WatchdogIntervals,
+		"Refresh intervals without a refresh after which a cache is reported stalled, 0 to disable")
+	flag.BoolVar(&config.WatchdogFailsHealth, "watchdog-fails-health", config.WatchdogFailsHealth,
+		"Report /healthcheck unhealthy while a cache is stalled")
+	flag.StringVar(&config.AccessLog, "access-log", config.AccessLog,
+		"Requests to log: off, all, or errors (4xx/5xx and proxied requests only)")
+	flag.IntVar(&config.ProxyCacheSize, "proxy-cache-size", config.ProxyCacheSize,
+		"Maximum number of unauthenticated proxied responses to cache, 0 to disable")
+	flag.DurationVar(&config.ProxyCacheTTL, "proxy-cache-ttl", config.ProxyCacheTTL,
+		"Time for which proxied responses are served from the proxy cache")
+	flag.BoolVar(&config.ProxyCacheNormalizeKeys, "proxy-cache-normalize-keys",
+		config.ProxyCacheNormalizeKeys,
+		"Share proxy cache entries between requests differing in query param order, path case or trailing slashes")
+	flag.BoolVar(&config.ProxyForceJSON, "proxy-force-json", config.ProxyForceJSON,
+		"Override the Accept header of proxied requests to request JSON from github")
+	flag.Int64Var(&config.MaxRequestBodyBytes, "max-request-body-bytes",
+		config.MaxRequestBodyBytes, "Maximum request body size, larger requests get a 413, 0 for unlimited")
+	flag.StringVar(&config.SnapshotFile, "snapshot-file", config.SnapshotFile,
+		"Serve the repos and views from this JSON file of repos without accessing github")
+	flag.Float64Var(&config.RateLimit, "rate-limit", config.RateLimit,
+		"Requests per second allowed per client IP, 0 to disable rate limiting")
+	flag.IntVar(&config.RateLimitBurst, "rate-limit-burst", config.RateLimitBurst,
+		"Burst of requests allowed per client IP above -rate-limit")
+	flag.StringVar(&config.TLSCertFile, "tls-cert", config.TLSCertFile,
+		"PEM certificate file to serve HTTPS with")
+	flag.StringVar(&config.TLSKeyFile, "tls-key", config.TLSKeyFile,
+		"PEM key file to serve HTTPS with")
+	flag.StringVar(&config.TLSClientCAFile, "tls-client-ca", config.TLSClientCAFile,
+		"PEM file of CAs whose client certificates are required, enabling mutual TLS")
+	flag.IntVar(&config.HistorySize, "history-size", config.HistorySize,
+		"Number of repos refreshes whose aggregate metrics are kept for /view/history, 0 to disable")
+	flag.DurationVar(&config.IdleTimeout, "idle-timeout", config.IdleTimeout,
+		"Exit after this long without requests other than probes, 0 to never exit")
+	flag.IntVar(&config.MaxRepoDropPercent, "max-repo-drop-percent", config.MaxRepoDropPercent,
+		"Reject repos refreshes dropping more than this percentage of the repos, 0 to disable")
+	flag.DurationVar(&config.RefreshTimeout, "refresh-timeout", config.RefreshTimeout,
+		"Deadline of each request to github fetching a page for a refresh, 0 for none")
+	flag.DurationVar(&config.ProxyTimeout, "proxy-timeout", config.ProxyTimeout,
+		"Deadline of each request proxied to github, after which the client gets a 504, 0 for none")
+	flag.DurationVar(&config.GitHubClientTimeout, "github-client-timeout",
+		config.GitHubClientTimeout, "Overall deadline of every request to github, body included, 0 for the default")
+	flag.DurationVar(&config.MaxRateLimitWait, "max-rate-limit-wait", config.MaxRateLimitWait,
+		"Maximum wait for github's rate limit to reset before retrying a refresh request, 0 for none")
+	flag.IntVar(&config.GitHubMaxAttempts, "github-max-attempts", config.GitHubMaxAttempts,
+		"Maximum attempts of each refresh request to github failing with a network error or a 502/503/504")
+	flag.DurationVar(&config.GitHubRetryBaseDelay, "github-retry-base-delay",
+		config.GitHubRetryBaseDelay, "Delay before the first retry of a refresh request to github, "+
+			"doubled for every further retry")
+	flag.StringVar(&config.LogLevel, "log-level", config.LogLevel,
+		"Minimum level of the messages logged: debug, info, warn or error")
+	flag.StringVar(&config.GitHubAPIVersion, "github-api-version", config.GitHubAPIVersion,
+		"Github API version to request, e.g. 2022-11-28, empty for github's default")
+	flag.StringVar(&config.RedisAddr, "redis-addr", config.RedisAddr,
+		"host:port of a Redis server storing the caches, shared between instances")
+	flag.BoolVar(&config.Follower, "follower", config.Follower,
+		"Read the caches from -redis-addr, refreshed by another instance, instead of github")
+	flag.IntVar(&config.MembersMaxPages, "members-max-pages", config.MembersMaxPages,
+		"Maximum number of pages of members fetched per refresh, 0 for all")
+	flag.BoolVar(&config.PrefetchPages, "prefetch-pages", config.PrefetchPages,
+		"Fetch the next page of paginated lists while decoding the current one")
+	flag.BoolVar(&config.EnableViews, "enable-views", config.EnableViews,
+		"Build and serve the /view/ rankings, false to save their cost")
+	flag.IntVar(&config.MaxGitHubConcurrency, "max-github-concurrency",
+		config.MaxGitHubConcurrency,
+		"Maximum number of concurrent requests to github by all refreshes, 0 for unlimited")
+	flag.BoolVar(&config.HealthCheckViews, "healthcheck-views", config.HealthCheckViews,
+		"Report /healthcheck unhealthy while the views are inconsistent with the cached repos")
+	flag.BoolVar(&config.StructuredErrors, "structured-errors", config.StructuredErrors,
+		"Reply all errors with the JSON envelope {\"error\":{\"code\",\"message\",\"status\"}}")
+	flag.IntVar(&config.DefaultViewCount, "default-view-count", config.DefaultViewCount,
+		"Number of repos listed by the views when the path omits it, e.g. /view/top/stars")
+	flag.Parse()
+
 	// Use port from command line or default to 8080.
 	port := int(8080)
-	if len (os.Args) > 1 {
-		portStr := os.Args[1]
+	if flag.NArg() > 0 {
+		portStr := flag.Arg(0)
 		var e error
 		port, e = strconv.Atoi(portStr)
 		if e != nil {
 			log.Panicf("Invalid port on cmdline %s", portStr)
 		}
 	}
+	if *extraCachedPaths != "" {
+		for _, path := range strings.Split(*extraCachedPaths, ",") {
+			if !strings.HasPrefix(path, "/") {
+				log.Panicf("Invalid -cached-paths entry %s, must start with /", path)
+			}
+			config.ExtraCachedPaths = append(config.ExtraCachedPaths, path)
+		}
+	}
+	config.ProxyResponseHeaders = nil
+	if *proxyResponseHeaders != "" {
+		config.ProxyResponseHeaders = strings.Split(*proxyResponseHeaders, ",")
+	}
+	if *proxyHiddenHeaders != "" {
+		config.ProxyHiddenHeaders = strings.Split(*proxyHiddenHeaders, ",")
+	}
+	if *viewMetrics != "" {
+		config.ViewMetrics = strings.Split(*viewMetrics, ",")
+		for _, metric := range config.ViewMetrics {
+			if !server.IsViewMetric(metric) {
+				log.Panicf("Invalid -view-metrics entry %s", metric)
+			}
+		}
+	}
+	// Refresh tickers can't tick at non-positive intervals.
+	if config.RefreshInterval <= 0 {
+		log.Panicf("Invalid -refresh-interval %v, must be positive", config.RefreshInterval)
+	}
+	parsePathDurations("refresh-intervals", *refreshIntervals, config.RefreshIntervals)
+	parsePathDurations("cache-ttls", *cacheTTLs, config.CacheTTLs)
+	if port == 0 && config.UnixSocket == "" {
+		log.Panicf("Port 0 disables TCP and requires -unix-socket")
+	}
+	if config.AccessLog != server.AccessLogOff && config.AccessLog != server.AccessLogAll &&
+		config.AccessLog != server.AccessLogErrors {
+		log.Panicf("Invalid -access-log %v, must be off, all or errors", config.AccessLog)
+	}
+	if config.RateLimit > 0 && config.RateLimitBurst < 1 {
+		log.Panicf("Invalid -rate-limit-burst %v, must be at least 1", config.RateLimitBurst)
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		log.Panicf("-tls-cert and -tls-key must be set together")
+	}
+	if config.TLSClientCAFile != "" && config.TLSCertFile == "" {
+		log.Panicf("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+	if config.MaxRepoDropPercent < 0 || config.MaxRepoDropPercent > 100 {
+		log.Panicf("Invalid -max-repo-drop-percent %v, must be between 0 and 100",
+			config.MaxRepoDropPercent)
+	}
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		log.Panicf("Invalid -log-level %v, must be debug, info, warn or error", config.LogLevel)
+	}
+	if config.DefaultViewCount < 0 {
+		log.Panicf("Invalid -default-view-count %v, must not be negative", config.DefaultViewCount)
+	}
+	if config.Follower && config.RedisAddr == "" {
+		log.Panicf("-follower requires -redis-addr")
+	}
+	if config.EmptyViewStatus != http.StatusOK && config.EmptyViewStatus != http.StatusNoContent {
+		log.Panicf("Invalid -empty-view-status %v, must be 200 or 204", config.EmptyViewStatus)
+	}
 	// Load API token from env.
 	apiToken := os.Getenv("GITHUB_API_TOKEN")
+	// Load the admin secret from env too, so that it doesn't show on the command line.
+	config.AdminSecret = os.Getenv("ADMIN_SECRET")
+	// The flag takes precedence over the env variable.
+	if *org == "" {
+		*org = os.Getenv("GITHUB_ORG")
+	}
+	if *org == "" {
+		*org = server.DefaultOrg
+	} else if strings.ContainsAny(*org, "/?#") {
+		log.Panicf("Invalid -org %s, must be a github org name", *org)
+	}
 	// Create and run the server.
-	s := server.NewServer(uint32(port), apiToken)
+	s := server.NewServer(uint32(port), apiToken, *org, config)
 	s.Run()
 }
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// This file contains the access logging done by the handler wrapper. Depending on
+// Config.AccessLog, every request is logged, or only the ones worth looking at: requests
+// that failed with a 4xx/5xx and requests that missed the cache and were proxied to github.
+
+// A response writer that records the status code written by the handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+// Per request state shared between the handler wrapper and the handlers, carried in the
+// request context.
+type requestInfo struct {
+	// Whether the request missed the cache and was proxied to github.
+	proxied bool
+}
+
+type requestInfoKey struct{}
+
+// Returns r with a fresh requestInfo attached to its context.
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	info := &requestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// Records that r was proxied to github.
+func markProxied(r *http.Request) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.proxied = true
+	}
+}
+
+// Logs a served request according to the configured access log mode.
+func (s *Server) logAccess(r *http.Request, status int, info *requestInfo,
+	elapsed time.Duration) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if s.config.AccessLog == AccessLogErrors && status < 400 && !info.proxied {
+		return
+	}
+	cache := "HIT"
+	if info.proxied {
+		cache = "MISS"
+	}
+	log.Printf("%v %v %v %v %v %v", r.RemoteAddr, r.Method, r.URL, status, cache, elapsed)
+}
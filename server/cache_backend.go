@@ -0,0 +1,268 @@
+package server
+
+import (
+	"api-cache/github_types"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// This file contains the storage of the cached bodies. They are kept in memory by default,
+// or in Redis with Config.RedisAddr so that several instances share them. With a shared
+// backend, only one instance needs to refresh from github: instances with Config.Follower
+// set never access github for the caches, and instead rebuild their views from the repos
+// in the backend at the refresh interval. The sorted views are stored too, so that
+// followers serve them in the order of the instance refreshing from github rather than
+// sorting them again, and so are the contributor counts, which come from github rather than
+// from the repos.
+
+// Storage of the cached bodies by path. Implementations must be safe for concurrent use.
+// Bodies passed to Set and returned by Get must not be modified.
+type CacheBackend interface {
+	// Returns the body cached for path, nil if there is none.
+	Get(path string) ([]byte, error)
+	// Caches body for path, replacing any previous body.
+	Set(path string, body []byte) error
+}
+
+// In-memory backend, used unless a shared backend is configured. The bodies are held in an
+// immutable map, which Set replaces by an updated copy, so that Get never takes a lock.
+// There are only a handful of cached paths, so the copies are cheap.
+type memoryBackend struct {
+	// Serializes the writers.
+	lock   sync.Mutex
+	bodies atomic.Pointer[map[string][]byte]
+}
+
+func newMemoryBackend() *memoryBackend {
+	b := &memoryBackend{}
+	b.bodies.Store(&map[string][]byte{})
+	return b
+}
+
+func (b *memoryBackend) Get(path string) ([]byte, error) {
+	return (*b.bodies.Load())[path], nil
+}
+
+func (b *memoryBackend) Set(path string, body []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	prev := *b.bodies.Load()
+	bodies := make(map[string][]byte, len(prev)+1)
+	for k, v := range prev {
+		bodies[k] = v
+	}
+	bodies[path] = body
+	b.bodies.Store(&bodies)
+	return nil
+}
+
+// Prefix of the Redis keys of the cached bodies.
+const kRedisKeyPrefix = "api-cache:"
+
+// Deadline of every Redis command, including connecting if needed.
+const kRedisTimeout = 5 * time.Second
+
+// Redis backend, speaking just enough of the Redis protocol (RESP) for GET and SET over a
+// single connection, which is re-established after any error.
+type redisBackend struct {
+	addr string
+	lock sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func newRedisBackend(addr string) *redisBackend {
+	return &redisBackend{addr: addr}
+}
+
+func (b *redisBackend) Get(path string) ([]byte, error) {
+	return b.do("GET", kRedisKeyPrefix+path)
+}
+
+func (b *redisBackend) Set(path string, body []byte) error {
+	_, err := b.do("SET", kRedisKeyPrefix+path, string(body))
+	return err
+}
+
+// Sends a command and returns its reply, nil for a nil reply.
+func (b *redisBackend) do(args ...string) ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.conn == nil {
+		conn, err := net.DialTimeout("tcp", b.addr, kRedisTimeout)
+		if err != nil {
+			return nil, err
+		}
+		b.conn, b.rd = conn, bufio.NewReader(conn)
+	}
+	b.conn.SetDeadline(time.Now().Add(kRedisTimeout))
+	reply, err := b.roundTrip(args)
+	if err != nil {
+		// The connection's state is unknown, start over with a new one.
+		b.conn.Close()
+		b.conn, b.rd = nil, nil
+	}
+	return reply, err
+}
+
+func (b *redisBackend) roundTrip(args []string) ([]byte, error) {
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := b.conn.Write([]byte(cmd)); err != nil {
+		return nil, err
+	}
+	line, err := b.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("malformed redis reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed redis reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(b.rd, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	return nil, fmt.Errorf("unexpected redis reply %q", line)
+}
+
+// Returns the body cached for path, logging any backend error and returning nil then.
+func (s *Server) getCache(path string) []byte {
+	body, err := s.cache.Get(path)
+	if err != nil {
+		log.Printf("Failed to read %v from the cache backend, err=%v", path, err)
+	}
+	return body
+}
+
+// Caches body for path, logging and returning false on a backend error. Must be called
+// without holding the lock, since the backend may be remote.
+func (s *Server) setCache(path string, body []byte) bool {
+	if err := s.cache.Set(path, body); err != nil {
+		log.Printf("Failed to write %v to the cache backend, keeping stale cache, err=%v",
+			path, err)
+		return false
+	}
+	return true
+}
+
+// Rebuilds the views from the repos in the shared backend, for followers.
+func (s *Server) reloadRepos(ctx context.Context) {
+	body, err := s.cache.Get(s.reposPath)
+	if err != nil {
+		log.Printf("Failed to reload %v from the cache backend, err=%v", s.reposPath, err)
+		return
+	} else if body == nil {
+		log.Printf("No %v in the cache backend yet", s.reposPath)
+		return
+	}
+	var repos []*github_types.Repository
+	if err := json.Unmarshal(body, &repos); err != nil {
+		log.Printf("Failed to decode %v from the cache backend, err=%v", s.reposPath, err)
+		return
+	}
+	s.ingestRepos(ctx, repos, "")
+}
+
+// Reloads the members from the shared backend, for followers.
+func (s *Server) reloadMembers(ctx context.Context) {
+	body, err := s.cache.Get(s.membersPath)
+	if err != nil {
+		log.Printf("Failed to reload %v from the cache backend, err=%v", s.membersPath, err)
+		return
+	} else if body == nil {
+		log.Printf("No %v in the cache backend yet", s.membersPath)
+		return
+	}
+	adminsBody, err := s.cache.Get(s.adminsPath)
+	if err != nil {
+		log.Printf("Failed to reload %v admins from the cache backend, err=%v", s.membersPath, err)
+		return
+	}
+	s.ingestMembers(body, adminsBody, "")
+}
+
+// Key of the sorted view of metric in the cache backend, see contributorsKey.
+func (s *Server) viewKey(metric string) string {
+	return s.reposPath + "#view/" + metric
+}
+
+// A sorted view as stored in the cache backend: the names of the repos in view order, along
+// with the checksum of the repos they were sorted from.
+type storedView struct {
+	Checksum string   `json:"checksum"`
+	Names    []string `json:"names"`
+}
+
+// Stores the sorted views by metric in the cache backend for followers, along with the
+// checksum of the repos they were sorted from. Views of disabled metrics are nil, and left
+// out.
+func (s *Server) storeViews(checksum string, views map[string][]*viewElm) {
+	for metric, sorted := range views {
+		if sorted == nil {
+			continue
+		}
+		view := storedView{Checksum: checksum, Names: make([]string, len(sorted))}
+		for ii, ve := range sorted {
+			view.Names[ii] = ve.name
+		}
+		body, _ := json.Marshal(view)
+		s.setCache(s.viewKey(metric), body)
+	}
+}
+
+// Returns elms in the order of the view of metric stored in the cache backend, for
+// followers, or nil if there is none for the repos of the given checksum, e.g. because the
+// repos were refreshed since the view was stored.
+func (s *Server) loadView(metric string, checksum string, elms []*viewElm) []*viewElm {
+	body := s.getCache(s.viewKey(metric))
+	if body == nil {
+		return nil
+	}
+	var view storedView
+	if err := json.Unmarshal(body, &view); err != nil {
+		log.Printf("Failed to decode the %v view from the cache backend, err=%v", metric, err)
+		return nil
+	}
+	if view.Checksum != checksum || len(view.Names) != len(elms) {
+		return nil
+	}
+	byName := make(map[string]*viewElm, len(elms))
+	for _, ve := range elms {
+		byName[ve.name] = ve
+	}
+	sorted := make([]*viewElm, len(view.Names))
+	for ii, name := range view.Names {
+		if sorted[ii] = byName[name]; sorted[ii] == nil {
+			return nil
+		}
+	}
+	return sorted
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// A repos body of a large org, around 1MB.
+var kBenchmarkBody = bytes.Repeat([]byte(`{"id":1,"name":"repo","stargazers_count":10},`), 25000)
+
+// Reads of the cached bodies, as the handlers used to do before the bodies were immutable:
+// copied under the lock. For comparison with BenchmarkMemoryBackendGet.
+func BenchmarkLockedCopyGet(b *testing.B) {
+	var lock sync.Mutex
+	caches := map[string][]byte{"/orgs/Netflix/repos": kBenchmarkBody}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lock.Lock()
+			body := make([]byte, len(caches["/orgs/Netflix/repos"]))
+			copy(body, caches["/orgs/Netflix/repos"])
+			lock.Unlock()
+		}
+	})
+}
+
+// Reads of the cached bodies by the handlers, sharing the immutable body without locking.
+func BenchmarkMemoryBackendGet(b *testing.B) {
+	backend := newMemoryBackend()
+	backend.Set("/orgs/Netflix/repos", kBenchmarkBody)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			backend.Get("/orgs/Netflix/repos")
+		}
+	})
+}
+
+// Bodies replaced by Set are still served whole to readers that got them before.
+func TestMemoryBackendSetKeepsReadBodies(t *testing.T) {
+	backend := newMemoryBackend()
+	backend.Set("/orgs/Netflix/repos", []byte("[1]"))
+	body, _ := backend.Get("/orgs/Netflix/repos")
+	backend.Set("/orgs/Netflix/repos", []byte("[2]"))
+	if string(body) != "[1]" {
+		t.Errorf("Got %s after a Set, want the body read before", body)
+	}
+	if body, _ := backend.Get("/orgs/Netflix/repos"); string(body) != "[2]" {
+		t.Errorf("Got %s, want the new body", body)
+	}
+	if body, _ := backend.Get("/orgs/Netflix/members"); body != nil {
+		t.Errorf("Got %s for a path never set, want nil", body)
+	}
+}
+
+// Starts a fake Redis serving GET and SET from memory, which replies an error to commands
+// on keys ending in /error and drops the connection on keys ending in /drop. Returns its
+// address, and counts the connections it accepted in conns.
+func fakeRedis(t *testing.T, conns *atomic.Int32) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var lock sync.Mutex
+	values := make(map[string]string)
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		rd := bufio.NewReader(conn)
+		for {
+			// Read a command, an array of bulk strings.
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			args := make([]string, n)
+			for ii := range args {
+				line, _ = rd.ReadString('\n')
+				size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+				buf := make([]byte, size+2)
+				if _, err := io.ReadFull(rd, buf); err != nil {
+					return
+				}
+				args[ii] = string(buf[:size])
+			}
+			lock.Lock()
+			value, ok := values[args[1]]
+			if args[0] == "SET" {
+				values[args[1]] = args[2]
+			}
+			lock.Unlock()
+			switch {
+			case strings.HasSuffix(args[1], "/drop"):
+				return
+			case strings.HasSuffix(args[1], "/error"):
+				conn.Write([]byte("-ERR fake failure\r\n"))
+			case args[0] == "SET":
+				conn.Write([]byte("+OK\r\n"))
+			case !ok:
+				conn.Write([]byte("$-1\r\n"))
+			default:
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go serve(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// The Redis backend round trips bodies, reports nil for missing keys and errors for error
+// replies, and reconnects after errors.
+func TestRedisBackend(t *testing.T) {
+	var conns atomic.Int32
+	backend := newRedisBackend(fakeRedis(t, &conns))
+	// Bodies may hold CRLFs, which bulk strings carry as is.
+	if err := backend.Set("/orgs/Netflix/repos", []byte("[1,\r\n2]")); err != nil {
+		t.Fatalf("Set failed, err=%v", err)
+	}
+	body, err := backend.Get("/orgs/Netflix/repos")
+	if err != nil || string(body) != "[1,\r\n2]" {
+		t.Errorf("Got %q, err=%v, want the body set", body, err)
+	}
+	if body, err := backend.Get("/orgs/Netflix/members"); err != nil || body != nil {
+		t.Errorf("Got %q, err=%v for a missing key, want nil", body, err)
+	}
+	if _, err := backend.Get("/error"); err == nil || err.Error() != "ERR fake failure" {
+		t.Errorf("Got err=%v for an error reply, want ERR fake failure", err)
+	}
+	if _, err := backend.Get("/drop"); err == nil {
+		t.Errorf("Got no error for a dropped connection")
+	}
+	body, err = backend.Get("/orgs/Netflix/repos")
+	if err != nil || string(body) != "[1,\r\n2]" {
+		t.Errorf("Got %q, err=%v after the connection dropped, want the body set", body, err)
+	}
+	// The connection is re-established after the error reply and after the drop.
+	if conns.Load() != 3 {
+		t.Errorf("Got %v connections, want 3", conns.Load())
+	}
+}
+
+// Followers serve the views in the order stored by the instance refreshing from github,
+// and sort them themselves if the stored views don't match their repos.
+func TestFollowerSharesViews(t *testing.T) {
+	fakeGitHub(t, fakeOrg(DefaultOrg, kTestRepos))
+	leader := newTestServer(t, DefaultOrg, nil)
+	leader.refreshCaches()
+	followerConfig := DefaultConfig()
+	followerConfig.Follower = true
+	follower := newTestServer(t, DefaultOrg, followerConfig)
+	follower.cache = leader.cache
+	follower.refreshCaches()
+	want := get(leader, "/view/top/2/stars").Body.String()
+	if got := get(follower, "/view/top/2/stars").Body.String(); got != want {
+		t.Errorf("Follower served %v, want %v", got, want)
+	}
+
+	// Stored orders are served as is, as long as they are for the follower's repos.
+	body, _ := leader.cache.Get(leader.viewKey("stars"))
+	var view storedView
+	json.Unmarshal(body, &view)
+	view.Names[0], view.Names[1] = view.Names[1], view.Names[0]
+	for _, test := range []struct {
+		checksum string
+		want     string
+	}{
+		{view.Checksum, `[["Netflix/a\"q",10],["Netflix/b",20]]`},
+		{"stale", `[["Netflix/b",20],["Netflix/a\"q",10]]`},
+	} {
+		view.Checksum = test.checksum
+		body, _ = json.Marshal(view)
+		leader.cache.Set(leader.viewKey("stars"), body)
+		follower.refreshCaches()
+		if got := get(follower, "/view/top/2/stars").Body.String(); got != test.want {
+			t.Errorf("Follower served %v for checksum %v, want %v", got, test.checksum,
+				test.want)
+		}
+	}
+}
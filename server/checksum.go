@@ -0,0 +1,48 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+// This file contains /orgs/<org>/repos/checksum, which serves a SHA-256 checksum of the
+// cached repos, computed once per refresh. Clients mirroring the repos poll the checksum,
+// and only download the repos again when it changes.
+
+// Suffix of the repos path serving their checksum.
+const kChecksumSuffix = "/checksum"
+
+// Returns the hex encoded SHA-256 checksum of the serialized repos.
+func reposChecksum(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the repos cache along with its generation, as per reposWithGeneration, and its
+// checksum. The checksum of the refresh that stored the repos is reused, except for
+// followers, whose repos may have been updated by the leader since their last reload.
+func (s *Server) reposWithChecksum() ([]byte, uint64, string) {
+	if snapshot := s.reposSnapshot.Load(); snapshot != nil && !s.config.Follower {
+		return snapshot.body, snapshot.generation, snapshot.checksum
+	}
+	body, generation := s.reposWithGeneration()
+	return body, generation, reposChecksum(body)
+}
+
+func handleReposChecksum(s *Server, w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	checksum := s.reposChecksum
+	setGenerationHeader(w, s.reposGeneration)
+	s.lock.RUnlock()
+	if checksum == "" {
+		s.writeJSONError(w, "Repos cache isn't populated yet", http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := json.Marshal(struct {
+		SHA256 string `json:"sha256"`
+	}{checksum})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// This file contains gzip compression of responses. Handlers write into a buffer, and the
+// buffered body is only compressed if the client accepts gzip and the body is at least
+// Config.CompressMinBytes long, since compressing tiny bodies costs CPU and can even grow
+// them.
+
+// A response writer that buffers the status and body until the handler returns.
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (b *bufferedResponseWriter) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	return b.buf.Write(p)
+}
+
+// Content codings responses can be compressed with, in order of preference when the client
+// accepts several equally. Brotli ("br") isn't supported: the standard library has no
+// Brotli encoder and the server takes no third-party dependencies, so clients accepting
+// both get gzip, and clients only accepting Brotli get uncompressed responses.
+var kContentCodings = []string{"gzip"}
+
+// Returns the content coding to compress the response to r with, negotiated from the
+// request's Accept-Encoding header: the supported coding with the highest q-value, ties
+// going to the preferred coding. Returns the empty string if none is acceptable.
+func negotiateEncoding(r *http.Request) string {
+	qs := make(map[string]float64)
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		qs[coding] = q
+	}
+	best, bestQ := "", 0.0
+	for _, coding := range kContentCodings {
+		q, ok := qs[coding]
+		if !ok {
+			// An explicitly listed coding takes precedence over the wildcard.
+			q, ok = qs["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// Returns whether the request's Accept-Encoding header allows a gzip response.
+func acceptsGzip(r *http.Request) bool {
+	return negotiateEncoding(r) == "gzip"
+}
+
+// Writes the response buffered in b to w, gzip compressed if the client accepts it and the
+// body is large enough.
+func (s *Server) writeCompressed(w http.ResponseWriter, r *http.Request,
+	b *bufferedResponseWriter) {
+	status := b.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	body := b.buf.Bytes()
+	// Handlers compressing on their own, e.g. the export, already vary on it.
+	if w.Header().Get("Vary") != "Accept-Encoding" {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if len(body) > 0 && len(body) >= s.config.CompressMinBytes && acceptsGzip(r) &&
+		w.Header().Get("Content-Encoding") == "" {
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		zw.Write(body)
+		zw.Close()
+		body = gz.Bytes()
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	// The whole body is known, so declare its length. This also gives HEAD requests, whose
+	// body net/http discards, the Content-Length of the corresponding GET. Handlers that
+	// don't write a body for HEAD requests (e.g. http.ServeContent) declare it themselves.
+	if r.Method != "HEAD" || len(body) > 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"deflate, gzip;q=0.5", "gzip"},
+		{"gzip;q=0", ""},
+		{"*", "gzip"},
+		{"*;q=1, gzip;q=0", ""},
+		{"identity", ""},
+		// Brotli isn't supported.
+		{"br", ""},
+		{"br, gzip", "gzip"},
+		{"br;q=1, gzip;q=0.1", "gzip"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", test.acceptEncoding)
+		if got := negotiateEncoding(r); got != test.want {
+			t.Errorf("Got %q for Accept-Encoding %q, want %q", got, test.acceptEncoding,
+				test.want)
+		}
+	}
+}
+
+// Proxied responses reach the client while github is still sending them, rather than once
+// buffered whole for compression.
+func TestProxiedResponsesStreamed(t *testing.T) {
+	release := make(chan struct{})
+	org := fakeOrg(DefaultOrg, kTestRepos)
+	fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/Netflix/a/commits" {
+			org.ServeHTTP(w, r)
+			return
+		}
+		// Larger than the buffers of net/http, so that it is sent before the handler returns.
+		w.Write(bytes.Repeat([]byte(" "), 64<<10))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("[]"))
+	}))
+	config := DefaultConfig()
+	config.CompressMinBytes = 0
+	ts := httptest.NewServer(newTestServer(t, DefaultOrg, config))
+	defer ts.Close()
+	defer close(release)
+	read := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(ts.URL + "/repos/Netflix/a/commits")
+		if err == nil {
+			defer resp.Body.Close()
+			_, err = io.ReadFull(resp.Body, make([]byte, 1))
+		}
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Errorf("Reading the body failed, err=%v", err)
+		}
+	case <-time.After(kResponsiveLatency):
+		t.Errorf("Proxied body not received while github was sending it")
+	}
+}
+
+// Cached responses are still compressed.
+func TestCachedResponsesCompressed(t *testing.T) {
+	config := DefaultConfig()
+	config.CompressMinBytes = 0
+	s := newRefreshedServer(t, config)
+	r := httptest.NewRequest("GET", "/orgs/Netflix/repos", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Got Content-Encoding %q, want gzip", got)
+	}
+	if !strings.Contains(w.Header().Get("Vary"), "Accept-Encoding") {
+		t.Errorf("Got Vary %q, want Accept-Encoding", w.Header().Get("Vary"))
+	}
+}
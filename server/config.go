@@ -0,0 +1,252 @@
+package server
+
+import (
+	"api-cache/http_utils"
+	"net/http"
+	"time"
+)
+
+// Access log modes.
+const (
+	// Don't log requests.
+	AccessLogOff = "off"
+	// Log every request.
+	AccessLogAll = "all"
+	// Only log requests that failed with a 4xx/5xx or were proxied to github.
+	AccessLogErrors = "errors"
+)
+
+// Config holds the tunable settings of the server. Use DefaultConfig() to get a config
+// populated with the defaults and override individual fields as needed.
+type Config struct {
+	// Interval at which the caches are refreshed. Defaults to 5 minutes.
+	RefreshInterval time.Duration
+	// Per cached path overrides of RefreshInterval, e.g. a longer interval for
+	// "/orgs/Netflix/members", which rarely changes. Paths without an entry are refreshed
+	// every RefreshInterval.
+	RefreshIntervals map[string]time.Duration
+	// Status code returned by the views when they have no results. Either http.StatusOK,
+	// sent with an empty JSON array as the body, or http.StatusNoContent, sent without a
+	// body. Defaults to http.StatusOK.
+	EmptyViewStatus int
+	// Maximum number of HTTP requests served concurrently. Requests beyond the cap get a
+	// 503 with a Retry-After header. Zero means unlimited, which is the default.
+	MaxConcurrentRequests int
+	// Whether archived and disabled repos are dropped from the cached repos list, and
+	// therefore from the views, when it is refreshed. Defaults to false.
+	ExcludeArchived bool
+	// Number of repos, the top ones by stars, whose contributor counts are fetched on each
+	// repos refresh to serve /view/top/N/contributors. This costs one github request per
+	// repo, so it defaults to 0, which disables the contributors view.
+	ContributorsTopK int
+	// Path of a unix domain socket to serve on, in addition to the TCP port. Empty, the
+	// default, disables it.
+	UnixSocket string
+	// Whether bodies fetched from github must be valid JSON to be accepted into the cache.
+	// Invalid bodies are logged and the stale cache is kept. Defaults to false.
+	ValidateJSON bool
+	// Number of top repos by stars, and by forks, exported as labeled gauges on /metrics.
+	// Each exported repo is a separate time series, so keep this small. Defaults to 10.
+	MetricsTopK int
+	// Minimum body size in bytes for a response to be gzip compressed when the client
+	// accepts it. Smaller bodies are sent uncompressed. Proxied responses are streamed as
+	// github compresses them instead. Defaults to 1KB, negative values disable compression.
+	CompressMinBytes int
+	// Number of refresh intervals after which the watchdog reports a cache whose refreshes
+	// haven't completed, successfully or not, as stalled. Defaults to 3, 0 disables the
+	// watchdog.
+	WatchdogIntervals int
+	// Whether /healthcheck reports unhealthy while the watchdog reports a stalled cache.
+	// Defaults to false, i.e. stalls are only logged.
+	WatchdogFailsHealth bool
+	// Which requests get logged, one of the AccessLog* modes. Defaults to AccessLogOff.
+	AccessLog string
+	// Maximum number of proxied responses kept in the proxy cache. Only successful GETs
+	// without an Authorization header are cached. Defaults to 0, which disables the cache.
+	ProxyCacheSize int
+	// Time for which a proxied response is served from the proxy cache. Defaults to 1
+	// minute.
+	ProxyCacheTTL time.Duration
+	// Whether proxied requests are sent with "Accept: application/vnd.github+json",
+	// overriding the client's Accept header, so that proxied responses are consistently
+	// JSON. Defaults to false, which passes the client's Accept header through.
+	ProxyForceJSON bool
+	// Whether the proxy cache keys are normalized, so that requests differing only in the
+	// order of their query params, in the case of their path or in trailing slashes share
+	// an entry. Defaults to false, since some github paths (e.g. file contents) are case
+	// sensitive.
+	ProxyCacheNormalizeKeys bool
+	// Per cached path TTLs. A cache requested after its TTL expired is refreshed right
+	// away in the background, independently of its refresh interval, while the request is
+	// served the stale cache. Paths without an entry are only refreshed by the refresh
+	// loop.
+	CacheTTLs map[string]time.Duration
+	// Maximum size in bytes of a request body. Larger requests get a 413. Defaults to
+	// 1MB, 0 means unlimited.
+	MaxRequestBodyBytes int64
+	// Path of a file holding a JSON array of repos to serve the repos cache and the views
+	// from, without ever accessing github. Empty, the default, disables snapshot mode.
+	SnapshotFile string
+	// Requests per second allowed per client IP, with bursts of up to RateLimitBurst
+	// requests. Clients over the limit get a 429 with a Retry-After header. The probes are
+	// exempt. Defaults to 0, which disables rate limiting.
+	RateLimit      float64
+	RateLimitBurst int
+	// PEM certificate and key files to serve HTTPS with instead of HTTP on the TCP port.
+	// Empty, the default, serves HTTP.
+	TLSCertFile string
+	TLSKeyFile  string
+	// PEM file of the CAs whose client certificates are accepted. If set, TLS clients
+	// must present a certificate signed by one of them on all routes but /livez. Empty,
+	// the default, disables mutual TLS.
+	TLSClientCAFile string
+	// Additional github paths to cache and serve from the cache, e.g. "/meta". They are
+	// fetched as a single page. Combine with RefreshIntervals to refresh low churn paths
+	// only every few hours.
+	ExtraCachedPaths []string
+	// Number of repos refreshes whose aggregate metrics are retained for
+	// /view/history/<metric>. Defaults to 288, i.e. a day at the default refresh
+	// interval. 0 disables the history.
+	HistorySize int
+	// Time without any request other than probes after which the server exits, for
+	// scale-to-zero deployments. Defaults to 0, which disables idle shutdown.
+	IdleTimeout time.Duration
+	// Maximum percentage by which the repo count may drop from one refresh to the next. A
+	// refresh dropping more repos is rejected, keeping the stale cache, as it most likely
+	// comes from a truncated response. Defaults to 0, which disables the check.
+	MaxRepoDropPercent int
+	// Deadline of every request to github fetching a page for a refresh. A refresh hitting
+	// it fails, keeping the stale cache. Defaults to 1 minute, 0 for none.
+	RefreshTimeout time.Duration
+	// Deadline of every request proxied to github. Clients get a 504 when it is hit.
+	// Defaults to 10 seconds, 0 for none.
+	ProxyTimeout time.Duration
+	// Overall deadline of every request to github, refreshes and proxied requests alike,
+	// body included, so that a hung connection can't block a refresh forever. It applies on
+	// top of RefreshTimeout and ProxyTimeout. Defaults to 30 seconds, which 0 also keeps.
+	GitHubClientTimeout time.Duration
+	// Maximum time a refresh waits for github's rate limit to reset before retrying a rate
+	// limited request. Longer waits are cut short. Defaults to 1 minute, 0 to fail rate
+	// limited requests right away.
+	MaxRateLimitWait time.Duration
+	// Maximum number of attempts of each request to github fetching a page for a refresh,
+	// retrying network errors and 502, 503 and 504 responses with exponential backoff
+	// within the refresh timeout. Defaults to 3, 1 never retries.
+	GitHubMaxAttempts int
+	// Delay before the first retry of a request to github, doubled for every further
+	// retry, with jitter. Defaults to 1 second.
+	GitHubRetryBaseDelay time.Duration
+	// Minimum level of the messages logged: debug, info, warn or error. Defaults to info.
+	// It can be changed at runtime through /admin/loglevel.
+	LogLevel string
+	// Secret that requests to the /admin/ endpoints must carry as "Authorization: Bearer
+	// <secret>". Defaults to empty, which refuses such requests.
+	AdminSecret string
+	// Github API version requested with the X-GitHub-Api-Version header, e.g. 2022-11-28,
+	// for fetched and proxied requests alike. Responses served from a cache carry the
+	// version the cache was fetched with in the same header. Defaults to empty, which
+	// requests github's default version.
+	GitHubAPIVersion string
+	// Address (host:port) of a Redis server in which the cached bodies are stored, so that
+	// several instances can share them. Defaults to empty, which keeps them in memory.
+	RedisAddr string
+	// Whether this instance only reads the caches from the shared Redis backend, which
+	// another instance refreshes, rather than fetching them from github. The views are
+	// rebuilt from the shared repos, sorted views and contributor counts at the refresh
+	// interval.
+	// Requires RedisAddr.
+	Follower bool
+	// Maximum number of pages of members fetched per refresh, truncating the members of
+	// huge orgs. Defaults to 0, which fetches all pages.
+	MembersMaxPages int
+	// Whether the next page of a paginated list is fetched while the current one is being
+	// decoded, rather than after. Defaults to false.
+	PrefetchPages bool
+	// Whether the views are built on each repos refresh and served under /view/. Disabling
+	// them saves the CPU and memory of sorting the repos for deployments that only use the
+	// cached endpoints and the proxy. The feed, the /metrics gauges, /admin/diff and the
+	// ?sort= and ?extras= params are derived from the views, and are empty without them.
+	// The paths under /view/ get a 404 when disabled. Defaults to true.
+	EnableViews bool
+	// Headers of github's responses relayed to the clients of the proxy. A trailing *
+	// matches any suffix, e.g. "X-RateLimit-*", and "*" relays all headers. Hop-by-hop
+	// headers are never relayed. Defaults to Content-Type, Link and the rate limit headers.
+	ProxyResponseHeaders []string
+	// Headers of github's responses never relayed to the clients of the proxy, even if
+	// they match ProxyResponseHeaders, with the same patterns. Defaults to none.
+	ProxyHiddenHeaders []string
+	// Maximum number of requests to github issued concurrently by all the refreshes
+	// together, e.g. to stay within a connection budget. Proxied requests aren't capped.
+	// Defaults to 0, which means unlimited.
+	MaxGitHubConcurrency int
+	// Whether /healthcheck reports unhealthy while the views are inconsistent with the
+	// cached repos, i.e. empty or holding a different number of repos, which reveals a
+	// refresh bug. Only applies with EnableViews. Defaults to false.
+	HealthCheckViews bool
+	// Whether all errors, including those of the proxy, are replied with the same JSON
+	// envelope {"error":{"code":"bad_request","message":"...","status":400}}, rather than
+	// in plain text, or as {"error":"..."} by the JSON endpoints. Defaults to false.
+	StructuredErrors bool
+	// Metrics whose views are precomputed on each repos refresh and served, e.g. stars and
+	// forks, saving the sorts of the others. Views of other metrics get a 404. The feed,
+	// /admin/diff, the ?extras= totals and the gauges don't depend on them, and sort on
+	// demand when their metric isn't precomputed. Defaults to empty, which enables all of
+	// them.
+	ViewMetrics []string
+	// Number of repos listed by the views when their path omits it, e.g. /view/top/stars.
+	// Defaults to 10.
+	DefaultViewCount int
+}
+
+// Returns a config populated with the default settings.
+func DefaultConfig() *Config {
+	return &Config{
+		RefreshInterval:      5 * time.Minute,
+		RefreshIntervals:     make(map[string]time.Duration),
+		CacheTTLs:            make(map[string]time.Duration),
+		EmptyViewStatus:      http.StatusOK,
+		MetricsTopK:          10,
+		CompressMinBytes:     1024,
+		WatchdogIntervals:    3,
+		AccessLog:            AccessLogOff,
+		ProxyCacheTTL:        time.Minute,
+		MaxRequestBodyBytes:  1 << 20,
+		RateLimitBurst:       20,
+		HistorySize:          288,
+		RefreshTimeout:       time.Minute,
+		ProxyTimeout:         10 * time.Second,
+		MaxRateLimitWait:     time.Minute,
+		GitHubClientTimeout:  http_utils.DefaultClientTimeout,
+		GitHubMaxAttempts:    3,
+		GitHubRetryBaseDelay: time.Second,
+		LogLevel:             "info",
+		EnableViews:          true,
+		DefaultViewCount:     10,
+		ProxyResponseHeaders: http_utils.DefaultForwardedHeaders,
+	}
+}
+
+// Returns whether the views of metric are precomputed and served. The contributors view
+// also needs ContributorsTopK.
+func (c *Config) viewMetricEnabled(metric string) bool {
+	if metric == "contributors" && c.ContributorsTopK <= 0 {
+		return false
+	}
+	if len(c.ViewMetrics) == 0 {
+		return true
+	}
+	for _, m := range c.ViewMetrics {
+		if m == metric {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the interval at which the cached path is refreshed.
+func (c *Config) refreshIntervalFor(path string) time.Duration {
+	if interval, ok := c.RefreshIntervals[path]; ok {
+		return interval
+	}
+	return c.RefreshInterval
+}
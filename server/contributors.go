@@ -0,0 +1,131 @@
+package server
+
+import (
+	"api-cache/http_utils"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// This file contains the optional contributors enrichment backing /view/top/N/contributors.
+// Contributor counts aren't part of the repos listing, so they cost one extra github request
+// per repo. The enrichment is therefore opt-in, limited to the top K repos by stars, and
+// stops early when the rate limit runs low. The counts are shared through the cache backend,
+// so that followers serve the same view without accessing github.
+
+// Stop enriching once fewer than this many requests remain in the rate limit window, so
+// that the regular cache refreshes are never starved.
+const kContributorsMinRateLimit = 500
+
+// Fetches contributor counts for the top config.ContributorsTopK elements by stars and
+// returns the enriched elements sorted by contributor count. The elements must not have
+// been published to the views yet, since their contributors field is written without
+// holding the lock. Stops early if ctx is canceled, in which case the result is partial.
+func (s *Server) fetchContributors(ctx context.Context, elms []*viewElm) []*viewElm {
+	k := s.config.ContributorsTopK
+	if k <= 0 {
+		return nil
+	}
+	byStars := make([]*viewElm, len(elms))
+	copy(byStars, elms)
+	sort.Slice(byStars, func(i, j int) bool {
+		a, b := byStars[i], byStars[j]
+		if a.stars != b.stars {
+			return a.stars > b.stars
+		}
+		return tieBreakLess(a, b)
+	})
+	if len(byStars) > k {
+		byStars = byStars[:k]
+	}
+
+	var enriched []*viewElm
+	for _, ve := range byStars {
+		// Request a single contributor per page, so that the page number of the last page
+		// is the number of contributors.
+		path := fmt.Sprintf("/repos/%s/%s/contributors?per_page=1&anon=true", s.org, ve.name)
+		g := http_utils.NewPagedGet(path, s.tokens, s.retryPolicy())
+		body, _, err := g.GetPage(ctx)
+		if ctx.Err() != nil {
+			log.Printf("Stopping contributors enrichment, err=%v", ctx.Err())
+			break
+		} else if err != nil {
+			// E.g. 451 for repos unavailable for legal reasons. Leave the repo out of the
+			// view rather than ranking it with zero contributors.
+			log.Printf("Skipping contributors of %v, err=%v", ve.name, err)
+			s.recordUnreachable(ctx, err)
+			s.recordFetchError(path, err)
+		} else if g.LastPage() > 0 {
+			ve.contributors = g.LastPage()
+			enriched = append(enriched, ve)
+		} else {
+			// A single page, possibly empty.
+			var contributors []json.RawMessage
+			json.Unmarshal(body, &contributors)
+			ve.contributors = len(contributors)
+			enriched = append(enriched, ve)
+		}
+		remaining := g.RateLimitRemaining()
+		if remaining >= 0 && remaining < kContributorsMinRateLimit {
+			log.Printf("Stopping contributors enrichment after %v repos, rate limit remaining %v",
+				len(enriched), remaining)
+			break
+		}
+	}
+	sortByContributors(enriched)
+	log.Printf("Fetched contributor counts for %v repos", len(enriched))
+	return enriched
+}
+
+// Sorts elms by decreasing contributor count.
+func sortByContributors(elms []*viewElm) {
+	sort.Slice(elms, func(i, j int) bool {
+		a, b := elms[i], elms[j]
+		if a.contributors != b.contributors {
+			return a.contributors > b.contributors
+		}
+		return tieBreakLess(a, b)
+	})
+}
+
+// Key of the contributor counts by repo name in the cache backend. It isn't a github path,
+// so it never collides with a cached body.
+func (s *Server) contributorsKey() string {
+	return s.reposPath + "#contributors"
+}
+
+// Stores the contributor counts of the enriched elements in the cache backend for followers.
+func (s *Server) storeContributors(enriched []*viewElm) {
+	counts := make(map[string]int, len(enriched))
+	for _, ve := range enriched {
+		counts[ve.name] = ve.contributors
+	}
+	body, _ := json.Marshal(counts)
+	s.setCache(s.contributorsKey(), body)
+}
+
+// Enriches elms with the contributor counts stored in the cache backend, for followers, and
+// returns the enriched elements sorted by contributor count. Repos without a stored count,
+// e.g. added since the counts were fetched, are left out of the view.
+func (s *Server) loadContributors(elms []*viewElm) []*viewElm {
+	body := s.getCache(s.contributorsKey())
+	if body == nil {
+		return nil
+	}
+	var counts map[string]int
+	if err := json.Unmarshal(body, &counts); err != nil {
+		log.Printf("Failed to decode the contributor counts from the cache backend, err=%v", err)
+		return nil
+	}
+	var enriched []*viewElm
+	for _, ve := range elms {
+		if n, ok := counts[ve.name]; ok {
+			ve.contributors = n
+			enriched = append(enriched, ve)
+		}
+	}
+	sortByContributors(enriched)
+	return enriched
+}
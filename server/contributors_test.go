@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Returns a fake github of the test repos, where a has 4 contributors and b 7, counting
+// the contributors requests in requests.
+func fakeContributors(requests *atomic.Int32) http.Handler {
+	org := fakeOrg(DefaultOrg, kTestRepos)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/contributors") {
+			org.ServeHTTP(w, r)
+			return
+		}
+		requests.Add(1)
+		last := 4
+		if r.URL.Path == "/repos/Netflix/b/contributors" {
+			last = 7
+		}
+		w.Header().Set("Link", fmt.Sprintf(`<https://api.github.com%v?per_page=1&page=%v>; `+
+			`rel="last"`, r.URL.Path, last))
+		w.Write([]byte(`[{"login":"bob"}]`))
+	})
+}
+
+// The contributors view is only served with ContributorsTopK, ranking the repos by the
+// contributor counts read off the Link headers.
+func TestContributorsViewNeedsTopK(t *testing.T) {
+	var requests atomic.Int32
+	fakeGitHub(t, fakeContributors(&requests))
+	s := newTestServer(t, DefaultOrg, nil)
+	s.refreshCaches()
+	if w := get(s, "/view/top/2/contributors"); w.Code != http.StatusNotFound {
+		t.Errorf("Got %v %v without ContributorsTopK, want 404", w.Code, w.Body.String())
+	}
+	config := DefaultConfig()
+	config.ContributorsTopK = 10
+	s = newTestServer(t, DefaultOrg, config)
+	s.refreshCaches()
+	w := get(s, "/view/top/2/contributors")
+	if want := `[["Netflix/b",7],["Netflix/a\"q",4]]`; w.Code != http.StatusOK ||
+		w.Body.String() != want {
+		t.Errorf("Got %v %v, want 200 %v", w.Code, w.Body.String(), want)
+	}
+}
+
+// Repos whose contributors are unavailable for legal reasons are left out of the view.
+func TestContributorsSkipsUnavailableForLegalReasons(t *testing.T) {
+	var requests atomic.Int32
+	contributors := fakeContributors(&requests)
+	fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/Netflix/a\"q/contributors" {
+			http.Error(w, `{"message":"Repository access blocked"}`,
+				http.StatusUnavailableForLegalReasons)
+			return
+		}
+		contributors.ServeHTTP(w, r)
+	}))
+	config := DefaultConfig()
+	config.ContributorsTopK = 10
+	s := newTestServer(t, DefaultOrg, config)
+	s.refreshCaches()
+	w := get(s, "/view/top/2/contributors")
+	if want := `[["Netflix/b",7]]`; w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("Got %v %v, want 200 %v", w.Code, w.Body.String(), want)
+	}
+}
+
+// Followers serve the contributors view from the counts of the instance refreshing from
+// github, without accessing github themselves.
+func TestFollowerSharesContributors(t *testing.T) {
+	var requests atomic.Int32
+	fakeGitHub(t, fakeContributors(&requests))
+	config := DefaultConfig()
+	config.ContributorsTopK = 10
+	leader := newTestServer(t, DefaultOrg, config)
+	leader.refreshCaches()
+	want := get(leader, "/view/top/2/contributors").Body.String()
+	if !strings.Contains(want, `"Netflix/b",7`) || requests.Load() != 2 {
+		t.Fatalf("Got %v after %v contributors requests, want both repos", want,
+			requests.Load())
+	}
+
+	followerConfig := DefaultConfig()
+	followerConfig.ContributorsTopK = 10
+	followerConfig.Follower = true
+	follower := newTestServer(t, DefaultOrg, followerConfig)
+	follower.cache = leader.cache
+	follower.refreshCaches()
+	if got := get(follower, "/view/top/2/contributors").Body.String(); got != want {
+		t.Errorf("Follower served %v, want %v", got, want)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("Follower made %v contributors requests, want none", requests.Load()-2)
+	}
+}
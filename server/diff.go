@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// This file contains /admin/diff, which reports what changed between the previous and the
+// current repos snapshots: repos that were added and removed, and per metric changes of the
+// repos present in both. The changes are paginated with ?limit= and ?offset=, counting the
+// added, then the removed, then the changed repos, and their total count is reported in
+// the X-Total-Count header. The diff is empty until the second refresh, since there is no
+// previous snapshot before.
+
+// Number of changes served when no limit is given.
+const kDiffDefaultLimit = 100
+
+// Maximum number of changes served at once.
+const kDiffMaxLimit = 1000
+
+// A change of a single metric.
+type metricChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// The changed metrics of a repo, keyed by metric name as used by the views.
+type repoChange struct {
+	Repo    string                  `json:"repo"`
+	Changes map[string]metricChange `json:"changes"`
+}
+
+type snapshotDiff struct {
+	Added   []string     `json:"added"`
+	Removed []string     `json:"removed"`
+	Changed []repoChange `json:"changed"`
+}
+
+// Returns a snapshot of the view elements keyed by repo name.
+func snapshotOf(elms []*viewElm) map[string]viewElm {
+	snapshot := make(map[string]viewElm, len(elms))
+	for _, ve := range elms {
+		snapshot[ve.name] = *ve
+	}
+	return snapshot
+}
+
+// Computes the diff from the prev to the curr snapshot of the repos of org. Repos are
+// reported in name order.
+func diffSnapshots(org string, prev map[string]viewElm, curr map[string]viewElm) *snapshotDiff {
+	diff := &snapshotDiff{Added: []string{}, Removed: []string{}, Changed: []repoChange{}}
+	var names []string
+	for name := range curr {
+		names = append(names, name)
+	}
+	for name := range prev {
+		if _, ok := curr[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p, inPrev := prev[name]
+		c, inCurr := curr[name]
+		repo := fmt.Sprintf("%s/%s", org, name)
+		if !inPrev {
+			diff.Added = append(diff.Added, repo)
+			continue
+		}
+		if !inCurr {
+			diff.Removed = append(diff.Removed, repo)
+			continue
+		}
+		changes := make(map[string]metricChange)
+		if p.forks != c.forks {
+			changes["forks"] = metricChange{p.forks, c.forks}
+		}
+		if !p.updated.Equal(c.updated) {
+			changes["last_updated"] = metricChange{p.updated.UTC().Format(time.RFC3339),
+				c.updated.UTC().Format(time.RFC3339)}
+		}
+		if p.openIssues != c.openIssues {
+			changes["open_issues"] = metricChange{p.openIssues, c.openIssues}
+		}
+		if p.stars != c.stars {
+			changes["stars"] = metricChange{p.stars, c.stars}
+		}
+		if len(changes) > 0 {
+			diff.Changed = append(diff.Changed, repoChange{Repo: repo, Changes: changes})
+		}
+	}
+	return diff
+}
+
+// Returns the number of changes in diff.
+func (d *snapshotDiff) count() int {
+	return len(d.Added) + len(d.Removed) + len(d.Changed)
+}
+
+// Returns the page of diff holding at most limit changes from offset on, counting the
+// added, then the removed, then the changed repos.
+func (d *snapshotDiff) page(offset int, limit int) *snapshotDiff {
+	page := &snapshotDiff{Added: []string{}, Removed: []string{}, Changed: []repoChange{}}
+	// Returns the bounds of the part of a list of n changes, starting at change start of
+	// the diff, that falls within the page.
+	bounds := func(start int, n int) (int, int) {
+		from := offset - start
+		if from < 0 {
+			from = 0
+		} else if from > n {
+			from = n
+		}
+		to := offset + limit - start
+		if to < from {
+			to = from
+		} else if to > n {
+			to = n
+		}
+		return from, to
+	}
+	from, to := bounds(0, len(d.Added))
+	page.Added = append(page.Added, d.Added[from:to]...)
+	from, to = bounds(len(d.Added), len(d.Removed))
+	page.Removed = append(page.Removed, d.Removed[from:to]...)
+	from, to = bounds(len(d.Added)+len(d.Removed), len(d.Changed))
+	page.Changed = append(page.Changed, d.Changed[from:to]...)
+	return page
+}
+
+// Parses the non negative integer query param name, returning def if it is absent.
+func parseCountParam(r *http.Request, name string, def int) (int, error) {
+	str := r.URL.Query().Get(name)
+	if str == "" {
+		return def, nil
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid %s %q, must be a non negative integer", name, str)
+	}
+	return value, nil
+}
+
+func handleAdminDiff(s *Server, w http.ResponseWriter, r *http.Request) {
+	limit, err := parseCountParam(r, "limit", kDiffDefaultLimit)
+	if err == nil && limit > kDiffMaxLimit {
+		err = fmt.Errorf("limit %d exceeds the maximum of %d", limit, kDiffMaxLimit)
+	}
+	if err != nil {
+		s.writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, err := parseCountParam(r, "offset", 0)
+	if err != nil {
+		s.writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	diff := &snapshotDiff{Added: []string{}, Removed: []string{}, Changed: []repoChange{}}
+	s.lock.RLock()
+	if s.prevSnapshot != nil {
+		diff = diffSnapshots(s.org, s.prevSnapshot, snapshotOf(s.viewElms))
+	}
+	s.lock.RUnlock()
+	w.Header().Set("X-Total-Count", strconv.Itoa(diff.count()))
+	diff = diff.page(offset, limit)
+	body, err := json.Marshal(diff)
+	if err != nil {
+		s.writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// This file contains the error responses of all handlers. By default errors are replied
+// in plain text like http.Error, except by the JSON endpoints such as the views, which
+// reply {"error":"<message>"}. With Config.StructuredErrors, every error, including those
+// of the proxy, is replied with the same JSON envelope:
+// {"error":{"code":"bad_request","message":"...","status":400}}.
+
+// Body of a structured error response.
+type errorEnvelope struct {
+	Error errorDetails `json:"error"`
+}
+
+type errorDetails struct {
+	// Snake case status text, e.g. service_unavailable for a 503.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Status  int    `json:"status"`
+}
+
+// Returns the code of a structured error with the given status, e.g. bad_request for 400.
+func errorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ReplaceAll(strings.ToLower(text), " ", "_")
+}
+
+// Writes v as the JSON body of an error response with the given status.
+func writeJSONErrorBody(w http.ResponseWriter, v interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	// Messages quote the request path, keep them readable.
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+// Replies to the request with a structured error envelope.
+func writeStructuredError(w http.ResponseWriter, message string, status int) {
+	writeJSONErrorBody(w, errorEnvelope{errorDetails{Code: errorCode(status),
+		Message: message, Status: status}}, status)
+}
+
+// Replies to the request with the given error message and status code, in plain text like
+// http.Error, or as a structured error envelope with Config.StructuredErrors.
+func (s *Server) writeError(w http.ResponseWriter, message string, status int) {
+	if s.config.StructuredErrors {
+		writeStructuredError(w, message, status)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+// Replies to the request with the given error message and status code as a JSON object
+// {"error":"<message>"}, for endpoints serving JSON, or as a structured error envelope with
+// Config.StructuredErrors.
+func (s *Server) writeJSONError(w http.ResponseWriter, message string, status int) {
+	if s.config.StructuredErrors {
+		writeStructuredError(w, message, status)
+		return
+	}
+	writeJSONErrorBody(w, struct {
+		Error string `json:"error"`
+	}{message}, status)
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+)
+
+// This file contains /export/repos.json, which serves the cached repos as a downloadable
+// attachment. Range requests are supported, so that large downloads can be resumed.
+
+func handleExportRepos(s *Server, w http.ResponseWriter, r *http.Request) {
+	body, generation, checksum := s.reposWithChecksum()
+	s.lock.RLock()
+	modTime := s.refreshedAt[s.reposPath]
+	s.lock.RUnlock()
+	setGenerationHeader(w, generation)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="repos.json"`)
+	// Compress regardless of the configured compression threshold, since the export is
+	// meant for large downloads. Ranges then apply to the compressed bytes, which are the
+	// same for the same cache.
+	w.Header().Add("Vary", "Accept-Encoding")
+	// The checksum identifies the content across restarts and instances, unlike the
+	// generation, letting If-Range requests resume safely. Each encoding is a distinct
+	// representation with its own ETag.
+	etag := fmt.Sprintf("\"%s\"", checksum)
+	if acceptsGzip(r) {
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		zw.Write(body)
+		zw.Close()
+		body = gz.Bytes()
+		w.Header().Set("Content-Encoding", "gzip")
+		etag = fmt.Sprintf("\"%s-gzip\"", checksum)
+	}
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "repos.json", modTime, bytes.NewReader(body))
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Serves a GET of the export by s with the given Range and Accept-Encoding headers.
+func getExportRange(s *Server, rangeHeader string, encoding string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", kExportRepos, nil)
+	if rangeHeader != "" {
+		r.Header.Set("Range", rangeHeader)
+	}
+	if encoding != "" {
+		r.Header.Set("Accept-Encoding", encoding)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// Serves a GET of the first 10 bytes of the export by s if its ETag is still etag.
+func getExportIfRange(s *Server, etag string, encoding string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", kExportRepos, nil)
+	r.Header.Set("Range", "bytes=0-9")
+	r.Header.Set("If-Range", etag)
+	if encoding != "" {
+		r.Header.Set("Accept-Encoding", encoding)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// Ranges of the export are served from the plain or the gzipped bytes, depending on the
+// encoding, and unsatisfiable ones get a 416.
+func TestExportRanges(t *testing.T) {
+	s := newRefreshedServer(t, nil)
+	full := getExportRange(s, "", "")
+	if full.Code != http.StatusOK || full.Body.Len() < 10 {
+		t.Fatalf("Got %v %v for the export, want 200 and the repos", full.Code, full.Body)
+	}
+	plain := full.Body.Bytes()
+	w := getExportRange(s, "bytes=0-9", "")
+	if want := fmt.Sprintf("bytes 0-9/%v", len(plain)); w.Code != http.StatusPartialContent ||
+		w.Header().Get("Content-Range") != want || !bytes.Equal(w.Body.Bytes(), plain[:10]) {
+		t.Errorf("Got %v %q %q for the first 10 bytes, want 206 %q %q", w.Code,
+			w.Header().Get("Content-Range"), w.Body, want, plain[:10])
+	}
+	w = getExportRange(s, fmt.Sprintf("bytes=%v-", len(plain)+100), "")
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Got %v for a range past the end, want 416", w.Code)
+	}
+
+	gzipped := getExportRange(s, "", "gzip")
+	zr, err := gzip.NewReader(bytes.NewReader(gzipped.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("Got %v for the gzipped export, err=%v", gzipped.Body, err)
+	}
+	if unzipped, _ := io.ReadAll(zr); gzipped.Header().Get("Content-Encoding") != "gzip" ||
+		!bytes.Equal(unzipped, plain) {
+		t.Errorf("Got %q gzipped, want the repos", unzipped)
+	}
+	w = getExportRange(s, "bytes=0-9", "gzip")
+	if want := fmt.Sprintf("bytes 0-9/%v", gzipped.Body.Len()); w.Code !=
+		http.StatusPartialContent || w.Header().Get("Content-Encoding") != "gzip" ||
+		w.Header().Get("Content-Range") != want ||
+		!bytes.Equal(w.Body.Bytes(), gzipped.Body.Bytes()[:10]) {
+		t.Errorf("Got %v %q for the first 10 gzipped bytes, want 206 %q", w.Code,
+			w.Header().Get("Content-Range"), want)
+	}
+}
+
+// The export's ETags are derived from the repos, so that they are the same after a restart,
+// and a resumed download of repos that changed since gets the whole new repos.
+func TestExportETag(t *testing.T) {
+	s := newRefreshedServer(t, nil)
+	plain := getExportRange(s, "", "")
+	sum := sha256.Sum256(plain.Body.Bytes())
+	want := `"` + hex.EncodeToString(sum[:]) + `"`
+	if etag := plain.Header().Get("ETag"); etag != want {
+		t.Errorf("Got ETag %v, want %v", etag, want)
+	}
+	gzipETag := getExportRange(s, "", "gzip").Header().Get("ETag")
+	if wantGzip := strings.TrimSuffix(want, `"`) + `-gzip"`; gzipETag != wantGzip {
+		t.Errorf("Got gzipped ETag %v, want %v", gzipETag, wantGzip)
+	}
+
+	restarted := newRefreshedServer(t, nil)
+	for _, test := range []struct {
+		etag     string
+		encoding string
+	}{{want, ""}, {gzipETag, "gzip"}} {
+		if w := getExportIfRange(restarted, test.etag, test.encoding); w.Code !=
+			http.StatusPartialContent {
+			t.Errorf("Got %v resuming with %v after a restart, want 206", w.Code, test.etag)
+		}
+	}
+
+	fakeGitHub(t, fakeOrg(DefaultOrg, strings.Replace(kTestRepos, `"stargazers_count":20`,
+		`"stargazers_count":25`, 1)))
+	restarted.refreshCaches()
+	if w := getExportIfRange(restarted, want, ""); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), `"stargazers_count":25`) {
+		t.Errorf("Got %v %v resuming with %v after the repos changed, want 200 and the new "+
+			"repos", w.Code, w.Body, want)
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"api-cache/http_utils"
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// This file contains the caching of the extra github paths configured in
+// Config.ExtraCachedPaths. These are meant for low churn endpoints such as /meta, whose
+// refresh interval can be set to hours with Config.RefreshIntervals so that github is
+// hardly ever hit for them. They are fetched as a single page and served as is.
+
+// Refreshes the cache of an extra path.
+func (s *Server) refreshExtraPath(ctx context.Context, path string) {
+	g := http_utils.NewPagedGet(path, s.tokens, s.retryPolicy())
+	body, _, err := g.GetPage(ctx)
+	if err != nil {
+		log.Printf("Failed to refresh %v cache, err=%v", path, err)
+		s.recordUnreachable(ctx, err)
+		s.recordFetchError(path, err)
+		return
+	}
+	if !s.acceptBody(path, body) || !s.setCache(path, body) {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.setAPIVersion(path, g.APIVersion())
+	s.refreshedAt[path] = time.Now()
+	log.Printf("Refreshed %v cache", path)
+}
+
+// Returns a handler serving the cache of an extra path.
+func extraPathHandler(path string) func(s *Server, w http.ResponseWriter, r *http.Request) {
+	return func(s *Server, w http.ResponseWriter, r *http.Request) {
+		body := s.getCache(path)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(body)
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// This file contains the Atom feed of recently updated repos served at /feed/updated. The
+// feed is built from the repos sorted by last update, so it is as fresh as the repos cache.
+
+// Maximum number of entries emitted in the feed.
+const kFeedMaxEntries = 50
+
+// Atom document structures. Only the elements required by RFC 4287 plus a link per entry
+// are emitted.
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+func handleFeedUpdated(s *Server, w http.ResponseWriter, r *http.Request) {
+	// Take the slices under the lock, since refreshNetflixRepos swaps in new sorted slices,
+	// and sort the elements if last_updated isn't precomputed.
+	s.lock.RLock()
+	lastUpdated, viewElms := s.lastUpdated, s.viewElms
+	s.lock.RUnlock()
+	lastUpdated = sortedOnDemand(lastUpdated, viewElms, lessLastUpdated)
+	n := len(lastUpdated)
+	if n > kFeedMaxEntries {
+		n = kFeedMaxEntries
+	}
+	elms := make([]viewElm, n)
+	for ii := 0; ii < n; ii++ {
+		elms[ii] = *lastUpdated[ii]
+	}
+
+	orgURL := "https://github.com/" + s.org
+	feed := atomFeed{
+		Title:  fmt.Sprintf("Recently updated %s repositories", s.org),
+		ID:     orgURL,
+		Author: atomAuthor{Name: s.org},
+		Link:   atomLink{Href: orgURL},
+	}
+	// The feed is as recent as its most recently updated entry.
+	if len(elms) > 0 {
+		feed.Updated = elms[0].updated.UTC().Format(time.RFC3339)
+	} else {
+		feed.Updated = time.Now().UTC().Format(time.RFC3339)
+	}
+	for _, ve := range elms {
+		link := fmt.Sprintf("%s/%s", orgURL, ve.name)
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   fmt.Sprintf("%s/%s", s.org, ve.name),
+			ID:      link,
+			Updated: ve.updated.UTC().Format(time.RFC3339),
+			Link:    atomLink{Href: link, Rel: "alternate"},
+		})
+	}
+
+	body, err := xml.Marshal(feed)
+	if err != nil {
+		s.writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
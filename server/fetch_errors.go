@@ -0,0 +1,51 @@
+package server
+
+import (
+	"api-cache/http_utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// This file contains /admin/errors, which reports the latest error response github
+// returned for each fetched path, with its raw body, e.g. a rate limit message or a
+// validation error, so that refresh failures can be debugged without reproducing them.
+// Bodies are truncated and have the secrets they may echo redacted, see GitHubError.
+
+// Latest error response of github for a fetched path.
+type fetchError struct {
+	// Time of the failure, RFC3339.
+	At        string `json:"at"`
+	Status    int    `json:"status"`
+	URL       string `json:"url"`
+	RequestID string `json:"request_id"`
+	// Raw body of the response, truncated and redacted.
+	Body string `json:"body"`
+}
+
+// Records the error response of a failed fetch of path, if err is a *GitHubError. Other
+// failures, e.g. network errors, have no response to record.
+func (s *Server) recordFetchError(path string, err error) {
+	var ghErr *http_utils.GitHubError
+	if !errors.As(err, &ghErr) {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fetchErrors[path] = fetchError{At: formatStatsTime(time.Now()), Status: ghErr.StatusCode,
+		URL: ghErr.URL, RequestID: ghErr.RequestID, Body: string(ghErr.Body)}
+}
+
+// Reports the latest error response of github for each fetched path, by path.
+func handleAdminErrors(s *Server, w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	body, err := json.Marshal(s.fetchErrors)
+	s.lock.RUnlock()
+	if err != nil {
+		s.writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
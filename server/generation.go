@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// This file contains the refresh generation reported in the X-Cache-Generation header of
+// the views and of the repos responses. Both are derived from the same repos refresh when
+// their generations are equal, so that clients combining a view with the repos can detect
+// having read across a refresh boundary and retry. Followers serve the repos straight from
+// the shared backend, which the leader may have updated since their last reload, so the
+// guarantee only holds for instances that refresh themselves.
+
+// Sets the X-Cache-Generation header to generation.
+func setGenerationHeader(w http.ResponseWriter, generation uint64) {
+	w.Header().Set("X-Cache-Generation", strconv.FormatUint(generation, 10))
+}
+
+// Repos cache stored by a repos refresh along with the generation it belongs to and its
+// checksum. It is published as a whole and never modified.
+type reposSnapshot struct {
+	body       []byte
+	generation uint64
+	checksum   string
+}
+
+// Returns the repos cache along with the generation it belongs to. Followers serve the
+// latest repos of the shared backend, along with the generation of their last reload.
+func (s *Server) reposWithGeneration() ([]byte, uint64) {
+	if s.config.Follower {
+		s.lock.RLock()
+		generation := s.reposGeneration
+		s.lock.RUnlock()
+		return s.getCache(s.reposPath), generation
+	}
+	snapshot := s.reposSnapshot.Load()
+	if snapshot == nil {
+		return s.getCache(s.reposPath), 0
+	}
+	return snapshot.body, snapshot.generation
+}
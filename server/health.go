@@ -0,0 +1,116 @@
+package server
+
+import (
+	"api-cache/http_utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// This file contains the JSON health summary served by /healthcheck to clients accepting
+// application/json. Besides readiness, it tells whether github was reachable on the latest
+// refreshes, distinguishing a healthy server from one that is degraded but still serving its
+// stale caches.
+
+// Health statuses.
+const (
+	// Ready, and the latest refreshes reached github.
+	kHealthOK = "ok"
+	// Ready and serving the caches, but the latest refresh of some cache couldn't reach
+	// github.
+	kHealthDegraded = "degraded"
+	// Not ready, see handleHealthCheck.
+	kHealthUnavailable = "unavailable"
+)
+
+// JSON body of the health summary.
+type healthSummary struct {
+	Status string `json:"status"`
+	// Whether the latest completed refreshes of all the cached paths reached github, see
+	// isUnreachable. Always false for followers and when serving a snapshot, which never
+	// refresh from github.
+	GitHubReachable bool `json:"github_reachable"`
+	// Time at which a refresh last reached github, RFC3339, empty if none did.
+	GitHubLastSuccess string `json:"github_last_success"`
+	// Whether the watchdog reports a stalled cache.
+	Stalled bool `json:"stalled"`
+	// Whether the views are consistent with the cached repos, see viewsConsistent. Only
+	// reported with Config.HealthCheckViews.
+	ViewsConsistent *bool `json:"views_consistent,omitempty"`
+}
+
+// Returns whether the view slices of the enabled metrics are non-empty and hold all the
+// cached repos. They are built together from the repos on each refresh, so a divergence
+// reveals a refresh bug. It only compares lengths to keep probes cheap. Must be called
+// with the lock held.
+func (s *Server) viewsConsistent() bool {
+	// There are no views to diverge.
+	if !s.config.EnableViews {
+		return true
+	}
+	n := len(s.repos)
+	if n == 0 {
+		return false
+	}
+	for metric, sorted := range map[string][]*viewElm{"forks": s.topForks,
+		"last_updated": s.lastUpdated, "open_issues": s.topOpenIssues, "stars": s.topStars} {
+		if s.config.viewMetricEnabled(metric) && len(sorted) != n {
+			return false
+		}
+	}
+	return true
+}
+
+// Outcome of the fetches from github of a refresh, carried by the context of the refresh,
+// see refreshOnce.
+type fetchOutcome struct {
+	// Whether a fetch failed to reach github.
+	unreachable atomic.Bool
+}
+
+// Key of the *fetchOutcome in the context of a refresh.
+type fetchOutcomeKey struct{}
+
+// Returns whether err shows that github couldn't be reached, i.e. a network error or a
+// server error, as opposed to github rejecting the request, e.g. with a 404 or a 451.
+func isUnreachable(err error) bool {
+	var ghErr *http_utils.GitHubError
+	if errors.As(err, &ghErr) {
+		return ghErr.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// Records that a fetch by the refresh of ctx failed with err, making github unreachable if
+// err says so. Fetches interrupted by Stop aren't github's failures.
+func (s *Server) recordUnreachable(ctx context.Context, err error) {
+	if outcome, ok := ctx.Value(fetchOutcomeKey{}).(*fetchOutcome); ok &&
+		ctx.Err() == nil && isUnreachable(err) {
+		outcome.unreachable.Store(true)
+	}
+}
+
+// Writes the health summary with the given status code, that of the plain health check.
+func writeHealthJSON(s *Server, w http.ResponseWriter, status int) {
+	s.lock.RLock()
+	summary := healthSummary{GitHubReachable: s.githubReachable,
+		GitHubLastSuccess: formatStatsTime(s.githubLastSuccess), Stalled: s.stalled}
+	if s.config.HealthCheckViews {
+		consistent := s.viewsConsistent()
+		summary.ViewsConsistent = &consistent
+	}
+	s.lock.RUnlock()
+	if status != http.StatusOK {
+		summary.Status = kHealthUnavailable
+	} else if summary.GitHubReachable || s.offline() || s.config.Follower {
+		summary.Status = kHealthOK
+	} else {
+		summary.Status = kHealthDegraded
+	}
+	body, _ := json.Marshal(summary)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(body)
+}
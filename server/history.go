@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// This file contains the bounded history of aggregate repo metrics, recorded on every repos
+// refresh and served at /view/history/<metric> as a time series of [time, value] pairs,
+// oldest first. Only the last Config.HistorySize refreshes are retained.
+
+// Aggregate metrics as of a repos refresh.
+type historyPoint struct {
+	at         time.Time
+	repoCount  int
+	totalStars int
+}
+
+// Appends a point to the history, dropping the oldest point once it is full. Must be
+// called with the lock held.
+func (s *Server) recordHistory(p historyPoint) {
+	if s.config.HistorySize <= 0 {
+		return
+	}
+	if len(s.history) >= s.config.HistorySize {
+		// Shift rather than reslice, so that the backing array doesn't grow forever.
+		copy(s.history, s.history[1:])
+		s.history = s.history[:len(s.history)-1]
+	}
+	s.history = append(s.history, p)
+}
+
+func handleViewHistory(s *Server, w http.ResponseWriter, r *http.Request) {
+	metric := strings.TrimPrefix(r.URL.Path, kViewHistory)
+	var value func(p historyPoint) int
+	if metric == "repo_count" {
+		value = func(p historyPoint) int { return p.repoCount }
+	} else if metric == "total_stars" {
+		value = func(p historyPoint) int { return p.totalStars }
+	} else {
+		s.writeError(w, fmt.Sprintf("Unknown history metric %q, valid metrics are: "+
+			"repo_count, total_stars", metric), http.StatusNotFound)
+		return
+	}
+	s.lock.RLock()
+	series := make([][2]interface{}, 0, len(s.history))
+	for _, p := range s.history {
+		series = append(series, [2]interface{}{p.at.UTC().Format(time.RFC3339), value(p)})
+	}
+	s.lock.RUnlock()
+	body, _ := json.Marshal(series)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
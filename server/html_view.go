@@ -0,0 +1,47 @@
+package server
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// This file contains the HTML rendering of the /view/top/N/<metric> views, served for
+// ?format=html as a simple leaderboard table linking to the repos on github.
+
+// A row of an HTML view.
+type htmlViewRow struct {
+	Rank int
+	Name string
+	// URL of the repo on github.
+	Link  string
+	Value string
+}
+
+// Leaderboard template. html/template escapes the repo names in both the text and the
+// link.
+var htmlViewTemplate = template.Must(template.New("view").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Top {{.Org}} repos by {{.Metric}}</title></head>
+<body>
+<h1>Top {{.Org}} repos by {{.Metric}}</h1>
+<table>
+<tr><th>#</th><th>Repo</th><th>{{.Metric}}</th></tr>
+{{range .Rows}}<tr><td>{{.Rank}}</td><td><a href="{{.Link}}">{{.Name}}</a></td><td>{{.Value}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Renders the rows of the view of the repos of org sorted by metric as an HTML table.
+func writeHTMLView(w http.ResponseWriter, org string, metric string, rows []htmlViewRow) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := htmlViewTemplate.Execute(w, struct {
+		Org    string
+		Metric string
+		Rows   []htmlViewRow
+	}{org, metric, rows})
+	if err != nil {
+		log.Printf("Failed to render HTML view, err=%v", err)
+	}
+}
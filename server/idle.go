@@ -0,0 +1,33 @@
+package server
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// This file contains the idle shutdown used for scale-to-zero deployments. When
+// Config.IdleTimeout is set, the server exits once it hasn't served a request for that
+// long, so that an orchestrator can scale it down. Refreshes don't count as requests, and
+// neither do the probes, since an orchestrator probes idle instances too.
+
+// Records that a request was received, unless it is a probe.
+func (s *Server) touch(path string) {
+	if s.config.IdleTimeout <= 0 || path == kRouteHealthCheck || path == kRouteLivez {
+		return
+	}
+	s.lastRequestAt.Store(time.Now().UnixNano())
+}
+
+// Loop until no request was received for IdleTimeout, then exit the process.
+func (s *Server) idleLoop() {
+	for {
+		deadline := time.Unix(0, s.lastRequestAt.Load()).Add(s.config.IdleTimeout)
+		now := time.Now()
+		if !now.Before(deadline) {
+			log.Printf("No requests received for %v, exiting", s.config.IdleTimeout)
+			os.Exit(0)
+		}
+		time.Sleep(deadline.Sub(now))
+	}
+}
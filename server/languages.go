@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// This file contains /view/languages, which reports how many cached repos have each
+// primary language, most used languages first. Repos without a detected language aren't
+// counted.
+
+type languageCount struct {
+	Language string `json:"language"`
+	Count    int    `json:"count"`
+}
+
+// Counts the repos with each primary language, sorted by count and then by language.
+func countLanguages(elms []*viewElm) []languageCount {
+	counts := make(map[string]int)
+	for _, ve := range elms {
+		if ve.language != "" {
+			counts[ve.language]++
+		}
+	}
+	languages := make([]languageCount, 0, len(counts))
+	for l, c := range counts {
+		languages = append(languages, languageCount{Language: l, Count: c})
+	}
+	sort.Slice(languages, func(i, j int) bool {
+		if languages[i].Count != languages[j].Count {
+			return languages[i].Count > languages[j].Count
+		}
+		return languages[i].Language < languages[j].Language
+	})
+	return languages
+}
+
+func handleViewLanguages(s *Server, w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	body, err := json.Marshal(s.languageCounts)
+	s.lock.RUnlock()
+	if err != nil {
+		s.writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// This file contains the runtime adjustable log level. All logging goes through a slog
+// handler filtered by the server's level var: log.Printf calls are logged at the info
+// level once the handler is the default, and verbose messages use slog.Debug. The level
+// is changed at runtime by POSTing /admin/loglevel?level=<level>, which requires the
+// admin secret.
+
+// Installs a default slog handler filtered by level. The standard logger, and thus
+// log.Printf, is redirected to it too.
+func setupLogging(level *slog.LevelVar) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+}
+
+// Returns whether r carries the admin secret as "Authorization: Bearer <secret>", writing
+// an error otherwise. Requests are always refused if no admin secret is configured.
+func (s *Server) checkAdminSecret(w http.ResponseWriter, r *http.Request) bool {
+	if s.config.AdminSecret == "" {
+		s.writeError(w, "No admin secret configured", http.StatusForbidden)
+		return false
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(s.config.AdminSecret)) != 1 {
+		s.writeError(w, "Invalid admin secret", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// Reports the log level on GET, and sets it on POST with ?level=debug|info|warn|error.
+func handleAdminLogLevel(s *Server, w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(r.URL.Query().Get("level"))); err != nil {
+			s.writeError(w, "level must be debug, info, warn or error", http.StatusBadRequest)
+			return
+		}
+		s.logLevel.Set(level)
+		log.Printf("Log level set to %v", level)
+	} else if r.Method != "GET" {
+		s.writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, _ := json.Marshal(map[string]string{"level": s.logLevel.Level().String()})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
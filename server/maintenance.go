@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// This file contains maintenance mode, in which the cached, view and proxy routes return a
+// 503 so that operators can quiesce the service without shutting it down. The probes and
+// the admin endpoints keep working, so that maintenance mode can be turned off again.
+
+// Seconds a client is asked to wait before retrying a request refused for maintenance.
+const kMaintenanceRetryAfterSecs = 60
+
+// Returns whether path keeps being served in maintenance mode. Only the registered admin
+// routes are, since other /admin/ paths fall through to the proxy.
+func servedInMaintenance(path string) bool {
+	switch path {
+	case kRouteHealthCheck, kRouteLivez, kAdminDiff, kAdminStats, kAdminMaintenance,
+		kAdminLogLevel, kAdminPagination, kAdminErrors:
+		return true
+	}
+	return false
+}
+
+// Reports maintenance mode on GET, and toggles it on POST with ?enabled=true|false.
+func handleAdminMaintenance(s *Server, w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			s.writeError(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		s.lock.Lock()
+		s.maintenance = enabled
+		s.lock.Unlock()
+		log.Printf("Maintenance mode set to %v", enabled)
+	} else if r.Method != "GET" {
+		s.writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.lock.RLock()
+	body, _ := json.Marshal(map[string]bool{"maintenance": s.maintenance})
+	s.lock.RUnlock()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
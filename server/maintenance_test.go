@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Admin secret of the test servers requiring one.
+const kTestAdminSecret = "s3cret"
+
+// Serves a POST of path by s, authenticated with secret unless it is empty.
+func post(s *Server, path string, secret string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, nil)
+	if secret != "" {
+		r.Header.Set("Authorization", "Bearer "+secret)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestMaintenance(t *testing.T) {
+	fakeGitHub(t, fakeOrg(DefaultOrg, kTestRepos))
+	config := DefaultConfig()
+	config.AdminSecret = kTestAdminSecret
+	s := newTestServer(t, DefaultOrg, config)
+	s.refreshCaches()
+	w := post(s, "/admin/maintenance?enabled=yes", kTestAdminSecret)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST of an invalid state got %v, want %v", w.Code, http.StatusBadRequest)
+	}
+	if w = post(s, "/admin/maintenance?enabled=true", kTestAdminSecret); w.Code != http.StatusOK {
+		t.Fatalf("POST got %v", w.Code)
+	}
+	// Unregistered admin paths are proxied, so they are refused like the other proxy routes.
+	for _, path := range []string{"/orgs/Netflix/repos", "/admin/foo"} {
+		if w := get(s, path); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Maintenance mode serves %v for %v, want %v", w.Code, path,
+				http.StatusServiceUnavailable)
+		}
+	}
+	if w := getAdmin(s, "/admin/maintenance"); w.Code != http.StatusOK {
+		t.Errorf("GET of the maintenance state got %v", w.Code)
+	}
+	post(s, "/admin/maintenance?enabled=false", kTestAdminSecret)
+	if w := get(s, "/orgs/Netflix/repos"); w.Code != http.StatusOK {
+		t.Errorf("Got %v after maintenance mode was turned off", w.Code)
+	}
+}
+
+// Maintenance mode can't be toggled without the admin secret.
+func TestMaintenanceNeedsAdminSecret(t *testing.T) {
+	fakeGitHub(t, fakeOrg(DefaultOrg, kTestRepos))
+	config := DefaultConfig()
+	config.AdminSecret = kTestAdminSecret
+	s := newTestServer(t, DefaultOrg, config)
+	s.refreshCaches()
+	for _, secret := range []string{"", "wrong"} {
+		w := post(s, "/admin/maintenance?enabled=true", secret)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("POST with secret %q got %v, want %v", secret, w.Code,
+				http.StatusUnauthorized)
+		}
+	}
+	if w := get(s, "/orgs/Netflix/repos"); w.Code != http.StatusOK {
+		t.Errorf("Got %v after refused POSTs, want 200", w.Code)
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Owners that can't be fetched, as with a token lacking the org admin scope, leave the
+// members cached with unknown roles rather than dropping the refresh.
+func TestMembersCachedWhenOwnersUnavailable(t *testing.T) {
+	org := fakeOrg(DefaultOrg, kTestRepos)
+	fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("role") == "admin" {
+			http.Error(w, `{"message":"Must have admin rights"}`, http.StatusForbidden)
+			return
+		}
+		org.ServeHTTP(w, r)
+	}))
+	s := newTestServer(t, DefaultOrg, nil)
+	s.refreshCaches()
+	w := get(s, "/orgs/Netflix/members")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"bob"`) {
+		t.Errorf("Got %v %v, want the cached members", w.Code, w.Body.String())
+	}
+	if w := get(s, "/orgs/Netflix/members?sort=login"); w.Code != http.StatusOK {
+		t.Errorf("Got %v for the members by login, want 200", w.Code)
+	}
+	for _, role := range []string{"admin", "member"} {
+		if w := get(s, "/orgs/Netflix/members?role="+role); w.Code !=
+			http.StatusServiceUnavailable {
+			t.Errorf("Got %v for role %v, want 503 while the roles are unknown", w.Code, role)
+		}
+	}
+}
+
+func TestMembersByRole(t *testing.T) {
+	fakeGitHub(t, fakeOrg(DefaultOrg, kTestRepos))
+	s := newTestServer(t, DefaultOrg, nil)
+	s.refreshCaches()
+	for role, want := range map[string]string{"admin": `"alice"`, "member": `"bob"`} {
+		w := get(s, "/orgs/Netflix/members?role="+role)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Got %v %v for role %v, want %v", w.Code, w.Body.String(), role, want)
+		}
+	}
+}
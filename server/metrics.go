@@ -0,0 +1,54 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// This file contains the /metrics endpoint, which exposes the popularity of the top repos as
+// Prometheus gauges in the text exposition format, e.g.
+//     repo_stars{repo="Netflix/x"} 123
+// Every exported repo is a separate time series, so only the top Config.MetricsTopK repos
+// by each metric are exported to bound the label cardinality. Repos dropping out of the top
+// K stop being exported, which ends their series.
+
+// Escapes a label value as required by the text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Writes a gauge family to buf with one sample per view element, labeled with the repo
+// qualified by org.
+func writeRepoGauge(buf *bytes.Buffer, org string, name string, help string, elms []*viewElm,
+	value func(ve *viewElm) int) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s gauge\n", name)
+	for _, ve := range elms {
+		fmt.Fprintf(buf, "%s{repo=\"%s/%s\"} %d\n", name, labelEscaper.Replace(org),
+			labelEscaper.Replace(ve.name), value(ve))
+	}
+}
+
+func handleMetrics(s *Server, w http.ResponseWriter, r *http.Request) {
+	k := s.config.MetricsTopK
+	var buf bytes.Buffer
+	s.lock.RLock()
+	topStars, topForks, elms := s.topStars, s.topForks, s.viewElms
+	// The slices are swapped rather than modified by refreshes, so sort the metrics that
+	// aren't precomputed and render without the lock.
+	s.lock.RUnlock()
+	topStars = sortedOnDemand(topStars, elms, lessStars)
+	if len(topStars) > k {
+		topStars = topStars[:k]
+	}
+	topForks = sortedOnDemand(topForks, elms, lessForks)
+	if len(topForks) > k {
+		topForks = topForks[:k]
+	}
+	writeRepoGauge(&buf, s.org, "repo_stars", "Number of stargazers of the top repos by stars.",
+		topStars, func(ve *viewElm) int { return ve.stars })
+	writeRepoGauge(&buf, s.org, "repo_forks", "Number of forks of the top repos by forks.",
+		topForks, func(ve *viewElm) int { return ve.forks })
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"api-cache/http_utils"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// This file contains the fetching of paginated github lists, whose pages are flattened into
+// a single list of items. The shape of the latest successful fetch of each list is
+// reported at /admin/pagination, to check that pagination fetches the expected amount.
+
+// Shape of the latest successful fetch of a paginated list.
+type paginationStats struct {
+	// Time of the fetch, RFC3339.
+	FetchedAt string `json:"fetched_at"`
+	// Number of pages fetched.
+	Pages int `json:"pages"`
+	// Number of items in all pages.
+	Items int `json:"items"`
+	// Page number of the last page as advertised by github's rel="last" link, 0 if none
+	// was advertised.
+	LastPage int `json:"last_page"`
+	// Whether pages were left unfetched because of a cap on the number of pages.
+	Truncated bool `json:"truncated"`
+}
+
+// A page fetched by GetPage, along with the metadata of its response. The metadata is
+// captured right after the page is fetched, since the PagedGet moves on to the next page.
+type fetchedPage struct {
+	body []byte
+	more bool
+	err  error
+	// Page number of the last page advertised by the page's response, see LastPage.
+	lastPage int
+	// API version the page was served with, see APIVersion.
+	apiVersion string
+}
+
+// Fetches the next page of g.
+func fetchPage(ctx context.Context, g *http_utils.PagedGet) fetchedPage {
+	var p fetchedPage
+	p.body, p.more, p.err = g.GetPage(ctx)
+	p.lastPage, p.apiVersion = g.LastPage(), g.APIVersion()
+	return p
+}
+
+// Fetches the pages of g one ahead of the consumer, up to maxPages of them if maxPages > 0,
+// until a page fails or the last page was fetched. The returned channel is closed once
+// done, or as soon as done is closed. Only the prefetching goroutine uses g, the consumer
+// must only read the pages' captured metadata.
+func prefetchPages(ctx context.Context, g *http_utils.PagedGet, maxPages int,
+	done chan struct{}) chan fetchedPage {
+	pages := make(chan fetchedPage)
+	go func() {
+		defer close(pages)
+		for fetched := 0; maxPages <= 0 || fetched < maxPages; fetched++ {
+			p := fetchPage(ctx, g)
+			select {
+			case pages <- p:
+			case <-done:
+				return
+			}
+			if p.err != nil || !p.more {
+				return
+			}
+		}
+	}()
+	return pages
+}
+
+// Fetches the pages of path and returns the items of all pages flattened into a single
+// slice, along with the API version of the latest response. At most maxPages
+// pages are fetched if maxPages > 0, truncating the list. On failure an error is returned
+// instead of a partial list, so that the stale cache is kept. With Config.PrefetchPages,
+// the next page is fetched while the current one is decoded.
+func (s *Server) fetchAllPages(ctx context.Context, path string, maxPages int) (
+	[]json.RawMessage, string, error) {
+	g := http_utils.NewPagedGet(path, s.tokens, s.retryPolicy())
+	var prefetched chan fetchedPage
+	if s.config.PrefetchPages {
+		done := make(chan struct{})
+		defer close(done)
+		prefetched = prefetchPages(ctx, g, maxPages, done)
+	}
+	var items []json.RawMessage
+	pages := 0
+	// Number of pages advertised by the first page's rel="last" link, 0 if unknown.
+	expected := 0
+	// Metadata of the latest page.
+	var lastPage int
+	var apiVersion string
+	truncated := false
+	for next := true; next; {
+		if maxPages > 0 && pages == maxPages {
+			truncated = true
+			log.Printf("Truncated %v to its first %v pages (%v items), more pages remain",
+				path, pages, len(items))
+			break
+		}
+		var p fetchedPage
+		if prefetched != nil {
+			p = <-prefetched
+			// The prefetcher stops at the first failure. Retry the page, which it didn't
+			// move past, and fetch the remaining pages sequentially.
+			if p.err != nil {
+				log.Printf("Prefetching %v failed, continuing sequentially, err=%v", path, p.err)
+				prefetched = nil
+			}
+		}
+		if prefetched == nil {
+			p = fetchPage(ctx, g)
+		}
+		if p.err != nil {
+			s.recordUnreachable(ctx, p.err)
+			s.recordFetchError(path, p.err)
+			return nil, "", p.err
+		}
+		body := p.body
+		next = p.more
+		lastPage, apiVersion = p.lastPage, p.apiVersion
+		pages++
+		if pages == 1 {
+			expected = p.lastPage
+			if !next {
+				expected = 1
+			}
+		}
+		// A single bad page would silently drop its items, so reject the whole list.
+		if !s.acceptBody(path, body) {
+			return nil, "", fmt.Errorf("invalid JSON in page %v", pages)
+		}
+		var pageItems []json.RawMessage
+		if err := http_utils.DecodeItems(body, &pageItems); err != nil {
+			return nil, "", fmt.Errorf("failed to decode page %v, err=%v", pages, err)
+		}
+		items = append(items, pageItems...)
+		slog.Debug(fmt.Sprintf("Fetched %v items of %v so far", len(items), path))
+	}
+	// Github occasionally advertises more (or fewer) pages than it serves, e.g. when the
+	// list changes during pagination. Keep what was fetched, but flag the mismatch.
+	if !truncated && expected > 0 && pages != expected {
+		slog.Warn(fmt.Sprintf("Fetched %v pages of %v but the first page advertised %v",
+			pages, path, expected))
+	}
+	s.lock.Lock()
+	s.pagination[path] = paginationStats{FetchedAt: formatStatsTime(time.Now()), Pages: pages,
+		Items: len(items), LastPage: lastPage, Truncated: truncated}
+	s.lock.Unlock()
+	return items, apiVersion, nil
+}
+
+// Reports the shape of the latest successful fetch of each paginated list, by path.
+func handleAdminPagination(s *Server, w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	body, err := json.Marshal(s.pagination)
+	s.lock.RUnlock()
+	if err != nil {
+		s.writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
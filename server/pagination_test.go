@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// Returns a fake github serving pages of path, page N holding the items of pages[N-1], whose
+// responses link to the next page and advertise lastPage as the last one.
+func fakePages(path string, pages []string, lastPage int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 0 {
+			page = 1
+		}
+		if page > len(pages) {
+			w.Write([]byte("[]"))
+			return
+		}
+		link := fmt.Sprintf(`<https://api.github.com%v?page=%v>; rel="last"`, path, lastPage)
+		if page < len(pages) {
+			link = fmt.Sprintf(`<https://api.github.com%v?page=%v>; rel="next", `, path,
+				page+1) + link
+		}
+		w.Header().Set("Link", link)
+		w.Header().Set("X-GitHub-Api-Version-Selected", fmt.Sprintf("2022-11-%02d", page))
+		w.Write([]byte(pages[page-1]))
+	})
+}
+
+// Pages of repos ids, 3 per page.
+func repoPages(n int) []string {
+	pages := make([]string, n)
+	for ii := range pages {
+		pages[ii] = fmt.Sprintf(`[{"id":%v},{"id":%v},{"id":%v}]`, 3*ii+1, 3*ii+2, 3*ii+3)
+	}
+	return pages
+}
+
+// Prefetching overlaps the fetch of a page with the decoding of the previous one, without
+// sharing the PagedGet between them. Run with -race.
+func TestFetchAllPagesPrefetch(t *testing.T) {
+	const path = "/orgs/Netflix/repos"
+	fakeGitHub(t, fakePages(path, repoPages(20), 20))
+	config := DefaultConfig()
+	config.PrefetchPages = true
+	s := newTestServer(t, DefaultOrg, config)
+	for run := 0; run < 5; run++ {
+		items, apiVersion, err := s.fetchAllPages(context.Background(), path, 0)
+		if err != nil {
+			t.Fatalf("Fetch failed, err=%v", err)
+		}
+		if len(items) != 60 {
+			t.Errorf("Fetched %v items, want 60", len(items))
+		}
+		if apiVersion != "2022-11-20" {
+			t.Errorf("Got API version %q of the latest page, want 2022-11-20", apiVersion)
+		}
+		if stats := s.pagination[path]; stats.Pages != 20 || stats.LastPage != 20 {
+			t.Errorf("Got stats %+v, want 20 pages", stats)
+		}
+	}
+}
+
+// Truncating the pages leaves the prefetcher behind without racing with it.
+func TestFetchAllPagesPrefetchTruncated(t *testing.T) {
+	const path = "/orgs/Netflix/members"
+	fakeGitHub(t, fakePages(path, repoPages(10), 10))
+	config := DefaultConfig()
+	config.PrefetchPages = true
+	s := newTestServer(t, DefaultOrg, config)
+	items, _, err := s.fetchAllPages(context.Background(), path, 4)
+	if err != nil {
+		t.Fatalf("Fetch failed, err=%v", err)
+	}
+	if len(items) != 12 || !s.pagination[path].Truncated {
+		t.Errorf("Got %v items and stats %+v, want 12 truncated items", len(items),
+			s.pagination[path])
+	}
+}
+
+// Github advertising more pages than it serves keeps what was fetched.
+func TestFetchAllPagesShortPageRun(t *testing.T) {
+	const path = "/orgs/Netflix/repos"
+	fakeGitHub(t, fakePages(path, repoPages(3), 5))
+	s := newTestServer(t, DefaultOrg, nil)
+	items, _, err := s.fetchAllPages(context.Background(), path, 0)
+	if err != nil {
+		t.Fatalf("Fetch failed, err=%v", err)
+	}
+	if len(items) != 9 {
+		t.Errorf("Fetched %v items, want the 9 items of the 3 served pages", len(items))
+	}
+	if stats := s.pagination[path]; stats.Pages != 3 || stats.Truncated {
+		t.Errorf("Got stats %+v, want 3 untruncated pages", stats)
+	}
+}
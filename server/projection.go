@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// This file contains the field projection of the cached repos, served for
+// /orgs/Netflix/repos?fields=name,description,homepage as an array of objects holding only
+// the requested fields.
+
+// Returns the repos as JSON objects holding only fields, with their keys sorted. The repo
+// fields are pointers and are omitted from the repo's JSON when nil, so a field that is
+// absent from a repo, e.g. a null description or homepage, is emitted as null rather than
+// dropped, and every object has every requested field.
+func projectRepos(repos []map[string]json.RawMessage, fields []string) ([]byte, error) {
+	projected := make([]map[string]json.RawMessage, 0, len(repos))
+	for _, repo := range repos {
+		p := make(map[string]json.RawMessage, len(fields))
+		for _, field := range fields {
+			if value, ok := repo[field]; ok {
+				p[field] = value
+			} else {
+				p[field] = json.RawMessage("null")
+			}
+		}
+		projected = append(projected, p)
+	}
+	return json.Marshal(projected)
+}
+
+// Serves the cached repos projected on the comma separated fields of the fields query
+// param.
+func handleNetflixRepoFields(s *Server, w http.ResponseWriter, r *http.Request) {
+	var fields []string
+	for _, field := range strings.Split(r.URL.Query().Get("fields"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 {
+		s.writeError(w, "fields must list at least one field", http.StatusBadRequest)
+		return
+	}
+	body, generation := s.reposWithGeneration()
+	s.lock.RLock()
+	generatedAt := s.refreshedAt[s.reposPath]
+	s.lock.RUnlock()
+	setGenerationHeader(w, generation)
+	var repos []map[string]json.RawMessage
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &repos); err != nil {
+			s.writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	body, err := projectRepos(repos, fields)
+	if err != nil {
+		s.writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("envelope") == "true" {
+		body = wrapInEnvelope(body, generatedAt)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
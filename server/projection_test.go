@@ -0,0 +1,26 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+// Null and missing description and homepage are projected as null.
+func TestProjectionNullFields(t *testing.T) {
+	const counts = `"forks_count":0,"open_issues_count":0,"stargazers_count":0,` +
+		`"updated_at":"2021-03-04T12:00:00Z"`
+	fakeGitHub(t, fakeOrg(DefaultOrg, `[
+{"id":1,"name":"a","description":null,"homepage":null,`+counts+`},
+{"id":2,"name":"b","description":"B \"quoted\"","homepage":"https://b.example.com",`+
+		counts+`},
+{"id":3,"name":"c",`+counts+`}]`))
+	s := newTestServer(t, DefaultOrg, nil)
+	s.refreshCaches()
+	w := get(s, "/orgs/Netflix/repos?fields=name,description,homepage")
+	want := `[{"description":null,"homepage":null,"name":"a"},` +
+		`{"description":"B \"quoted\"","homepage":"https://b.example.com","name":"b"},` +
+		`{"description":null,"homepage":null,"name":"c"}]`
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("Got %v %v, want 200 %v", w.Code, w.Body.String(), want)
+	}
+}
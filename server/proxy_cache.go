@@ -0,0 +1,160 @@
+package server
+
+import (
+	"api-cache/http_utils"
+	"bytes"
+	"container/list"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains the optional LRU cache of proxied responses. Only successful GETs
+// without an Authorization header are cached, since responses to authenticated requests
+// may hold data the next client must not see. Entries are keyed by path and query, so that
+// e.g. ?page=2 is never served from the entry of ?page=1, and by the request headers github
+// varies its responses on, so that e.g. a gzipped body is never served to a client that
+// didn't ask for it.
+
+// Request headers that are part of the cache key, since they select the representation
+// github responds with.
+var kProxyCacheKeyHeaders = []string{"Accept", "Accept-Encoding", "X-GitHub-Api-Version"}
+
+// A cached proxied response.
+type proxyEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// LRU cache of proxied responses.
+type proxyCache struct {
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func newProxyCache(size int, ttl time.Duration) *proxyCache {
+	return &proxyCache{size: size, ttl: ttl, lru: list.New(),
+		entries: make(map[string]*list.Element)}
+}
+
+// Returns the cache key of a proxied request. If normalize is set, requests that only
+// differ in the order of their query params, in the case of their path or in trailing
+// slashes share a key. The headers of kProxyCacheKeyHeaders are never normalized away.
+func proxyCacheKey(r *http.Request, normalize bool) string {
+	path, query := r.URL.Path, r.URL.RawQuery
+	if normalize {
+		path = strings.ToLower(path)
+		if trimmed := strings.TrimRight(path, "/"); trimmed != "" {
+			path = trimmed
+		}
+		// Encode sorts the params by key, keeping the order of repeated keys' values.
+		query = r.URL.Query().Encode()
+	}
+	key := path
+	if query != "" {
+		key += "?" + query
+	}
+	for _, h := range kProxyCacheKeyHeaders {
+		key += "\n" + strings.Join(r.Header.Values(h), ",")
+	}
+	return key
+}
+
+// Returns the unexpired entry for key, or nil.
+func (c *proxyCache) get(key string, now time.Time) *proxyEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elm, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elm.Value.(*proxyEntry)
+	if now.After(entry.expires) {
+		c.lru.Remove(elm)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(elm)
+	return entry
+}
+
+// Adds an entry, evicting the least recently used one if the cache is full.
+func (c *proxyCache) add(entry *proxyEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elm, ok := c.entries[entry.key]; ok {
+		c.lru.Remove(elm)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*proxyEntry).key)
+	}
+}
+
+// A response writer recording a proxied response so that it can be cached.
+type proxyRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (pr *proxyRecorder) Header() http.Header {
+	return pr.header
+}
+
+func (pr *proxyRecorder) WriteHeader(status int) {
+	if pr.status == 0 {
+		pr.status = status
+	}
+}
+
+func (pr *proxyRecorder) Write(p []byte) (int, error) {
+	if pr.status == 0 {
+		pr.status = http.StatusOK
+	}
+	return pr.body.Write(p)
+}
+
+// Writes a cached or recorded response to w.
+func writeProxyEntry(w http.ResponseWriter, entry *proxyEntry) {
+	for k, v := range entry.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+// Proxies r to github, serving it from the proxy cache if possible.
+func (s *Server) forwardCached(w http.ResponseWriter, r *http.Request) {
+	key := proxyCacheKey(r, s.config.ProxyCacheNormalizeKeys)
+	if entry := s.proxyCache.get(key, time.Now()); entry != nil {
+		writeProxyEntry(w, entry)
+		return
+	}
+	markProxied(r)
+	rec := &proxyRecorder{header: make(http.Header)}
+	err := http_utils.Forward(rec, r, s.config.ProxyForceJSON)
+	if err != nil {
+		log.Printf("Proxied request failed, err=%v", err)
+	}
+	entry := &proxyEntry{key: key, status: rec.status, header: rec.header,
+		body: rec.body.Bytes(), expires: time.Now().Add(s.proxyCache.ttl)}
+	if entry.status == 0 {
+		entry.status = http.StatusOK
+	}
+	// Failures, e.g. the client going away mid-body, may have recorded a partial 200.
+	if entry.status == http.StatusOK && err == nil {
+		s.proxyCache.add(entry)
+	}
+	writeProxyEntry(w, entry)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// Returns a server with a proxy cache, proxying to a fake github that counts its requests
+// in hits and replies with the page of each, gzipped if accepted.
+func newProxyCacheServer(t *testing.T, hits *atomic.Int32) *Server {
+	org := fakeOrg(DefaultOrg, kTestRepos)
+	fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/Netflix/a/issues" {
+			org.ServeHTTP(w, r)
+			return
+		}
+		hits.Add(1)
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			w.Write([]byte(r.URL.Query().Get("page")))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte(r.URL.Query().Get("page")))
+		zw.Close()
+	}))
+	config := DefaultConfig()
+	config.ProxyCacheSize = 10
+	return newTestServer(t, DefaultOrg, config)
+}
+
+// Serves a GET of path with the Accept-Encoding encoding by s.
+func getEncoded(s *Server, path string, encoding string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	if encoding != "" {
+		r.Header.Set("Accept-Encoding", encoding)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// Different pages of a proxied list are cached in distinct entries.
+func TestProxyCacheKeyedByPage(t *testing.T) {
+	var hits atomic.Int32
+	s := newProxyCacheServer(t, &hits)
+	for run := 0; run < 2; run++ {
+		for _, page := range []string{"1", "2"} {
+			body := getEncoded(s, "/repos/Netflix/a/issues?per_page=5&page="+page, "")
+			if body.Body.String() != page {
+				t.Errorf("Got %q for page %v", body.Body, page)
+			}
+		}
+	}
+	if hits.Load() != 2 {
+		t.Errorf("Github got %v requests, want one per page", hits.Load())
+	}
+}
+
+// A response in one encoding is never served to a client asking for another.
+func TestProxyCacheKeyedByEncoding(t *testing.T) {
+	var hits atomic.Int32
+	s := newProxyCacheServer(t, &hits)
+	for _, encoding := range []string{"gzip", "", "gzip", ""} {
+		w := getEncoded(s, "/repos/Netflix/a/issues?page=1", encoding)
+		if uncompressed := w.Body.String() == "1"; uncompressed != (encoding == "") {
+			t.Errorf("Got %q for Accept-Encoding %q", w.Body, encoding)
+		}
+	}
+	if hits.Load() != 2 {
+		t.Errorf("Github got %v requests, want one per encoding", hits.Load())
+	}
+}
+
+func TestProxyCacheKeyNormalization(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"/repos/Netflix/a?page=2&per_page=5", "/repos/Netflix/a?per_page=5&page=2", true},
+		{"/repos/Netflix/A", "/repos/netflix/a", true},
+		{"/repos/Netflix/a/", "/repos/Netflix/a", true},
+		{"/repos/Netflix/a//", "/repos/Netflix/a", true},
+		{"/", "/", true},
+		{"/repos/Netflix/a?page=1", "/repos/Netflix/a?page=2", false},
+		{"/repos/Netflix/a?q=1&q=2", "/repos/Netflix/a?q=2&q=1", false},
+		{"/repos/Netflix/a", "/repos/Netflix/b", false},
+	}
+	for _, test := range tests {
+		a := proxyCacheKey(httptest.NewRequest("GET", test.a, nil), true)
+		b := proxyCacheKey(httptest.NewRequest("GET", test.b, nil), true)
+		if (a == b) != test.equal {
+			t.Errorf("Got keys %q and %q for %v and %v, want equal %v", a, b, test.a, test.b,
+				test.equal)
+		}
+	}
+	// Without normalization, only identical requests share a key.
+	a := proxyCacheKey(httptest.NewRequest("GET", "/repos/Netflix/a?b=1&a=1", nil), false)
+	b := proxyCacheKey(httptest.NewRequest("GET", "/repos/Netflix/a?a=1&b=1", nil), false)
+	if a == b {
+		t.Errorf("Got the same key %q for differently ordered queries without normalization", a)
+	}
+	// The representation headers are never normalized away.
+	r := httptest.NewRequest("GET", "/repos/Netflix/a", nil)
+	r.Header.Set("Accept", "application/vnd.github.raw")
+	if proxyCacheKey(r, true) == proxyCacheKey(httptest.NewRequest("GET", "/repos/Netflix/a",
+		nil), true) {
+		t.Errorf("Got the same key for different Accept headers")
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// This file contains the per client IP rate limiter applied by the handler wrapper. Each
+// IP gets a token bucket refilled at Config.RateLimit tokens per second up to
+// Config.RateLimitBurst tokens, and every request takes a token. Clients are identified by
+// the remote address of the connection, so clients behind a shared proxy share a bucket.
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type ipRateLimiter struct {
+	lock    sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	// Time at which idle buckets were last dropped.
+	lastSweep time.Time
+}
+
+func newIPRateLimiter(rate float64, burst int) *ipRateLimiter {
+	return &ipRateLimiter{rate: rate, burst: float64(burst),
+		buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+// Takes a token from the bucket of ip. If the bucket is empty, returns false along with
+// the time until the bucket holds a token again.
+func (l *ipRateLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// Drops the buckets that have refilled completely, since they are equivalent to new ones,
+// to keep the map from growing with every client ever seen. Runs at most once a minute.
+func (l *ipRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// Returns the IP of the client that sent r.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Returns whether path is exempt from rate limiting.
+func rateLimitExempt(path string) bool {
+	return path == kRouteHealthCheck || path == kRouteLivez
+}
+
+// Rate limits r, writing a 429 and returning false if its client is over the limit.
+func (s *Server) checkRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	if s.rateLimiter == nil || rateLimitExempt(r.URL.Path) {
+		return true
+	}
+	ok, wait := s.rateLimiter.allow(clientIP(r), time.Now())
+	if ok {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	s.writeError(w, "Too many requests", http.StatusTooManyRequests)
+	return false
+}
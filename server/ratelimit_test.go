@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// A client over its burst gets a 429 with a Retry-After header, while other clients and
+// the probes are served.
+func TestRateLimitPerClient(t *testing.T) {
+	config := DefaultConfig()
+	config.RateLimit = 0.01
+	config.RateLimitBurst = 3
+	s := newRefreshedServer(t, config)
+	getFrom := func(ip string, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = ip + ":1234"
+		s.ServeHTTP(w, r)
+		return w
+	}
+	for run := 0; run < config.RateLimitBurst; run++ {
+		if w := getFrom("10.0.0.1", "/view/top/1/stars"); w.Code != http.StatusOK {
+			t.Fatalf("Got %v for request %v within the burst, want 200", w.Code, run+1)
+		}
+	}
+	w := getFrom("10.0.0.1", "/view/top/1/stars")
+	if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); w.Code !=
+		http.StatusTooManyRequests || retryAfter <= 0 {
+		t.Errorf("Got %v with Retry-After %q over the burst, want 429 with a delay", w.Code,
+			w.Header().Get("Retry-After"))
+	}
+	if w := getFrom("10.0.0.2", "/view/top/1/stars"); w.Code != http.StatusOK {
+		t.Errorf("Got %v for another client, want 200", w.Code)
+	}
+	if w := getFrom("10.0.0.1", "/livez"); w.Code != http.StatusOK {
+		t.Errorf("Got %v for a probe over the burst, want 200", w.Code)
+	}
+}
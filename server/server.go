@@ -3,136 +3,646 @@ package server
 import (
 	"api-cache/github_types"
 	"api-cache/http_utils"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 
 // This file contains the implementation of a server that provides a GitHub API read cache
 // service. It performs the following :
-// (1) Serve cached results for
+// (0) Serve probes for readiness at /healthcheck and liveness at /livez. /healthcheck
+//     serves a JSON summary including github's reachability with Accept: application/json.
+// (1) Serve cached results for, <org> being the org passed to NewServer,
 //     /
-//     /orgs/Netflix
-//     /orgs/Netflix/members
-//     /orgs/Netflix/repos
-// (2) Provide views for
+//     /orgs/<org>
+//     /orgs/<org>/members
+//     /orgs/<org>/repos
+//     and the paths in Config.ExtraCachedPaths
+//     along with the checksum of the cached repos at /orgs/<org>/repos/checksum
+// (2) Provide views, unless disabled with Config.EnableViews, for
 //     /view/top/N/forks
 //     /view/top/N/last_updated
 //     /view/top/N/open_issues
 //     /view/top/N/stars
-// (3) Proxies all other urls to github.
+//     /view/top/N/contributors (opt-in, see Config.ContributorsTopK)
+//     /view/topics
+//     /view/languages
+//     /view/history/repo_count
+//     /view/history/total_stars
+//     N may be omitted, e.g. /view/top/stars, to list Config.DefaultViewCount repos.
+//     Malformed paths and invalid params get a 400 with a {"error":"..."} JSON body.
+//     Views accept an optional ?license=<spdx id> filter, and an ?updated_within=30d (or
+//     12h) filter ranking only the repos updated within the window. Timestamps are formatted
+//     according to ?time_format=rfc3339 (default), unix or unixms. /view/top views are
+//     rendered as an HTML table with ?format=html. They can be sorted by several metrics,
+//     e.g. /view/top/N/stars,forks sorts by stars then forks and lists both values.
+//     With ?default_branch=true, each row ends with the repo's default branch, null when
+//     github reported none, e.g. ["Netflix/x",stars,"main"].
+//     With ?deltas=true, the values are followed by their changes since the previous
+//     refresh, e.g. ["Netflix/x",stars,forks,stars_delta,forks_delta]. HTML views omit them.
+//     Repo names are qualified with the org unless ?qualified=false.
+//     /orgs/<org>/repos and /orgs/<org>/members accept ?envelope=true to wrap the
+//     cached array as {"generated_at":"<last refresh>","data":[...]}.
+//     /orgs/<org> accepts ?extras=true to add totals computed from the cached repos.
+//     /orgs/<org>/repos accepts ?names_only=true to serve only the repo names, and
+//     ?fields=name,description,... to serve only the given fields of each repo, null when
+//     github had none. ?sort=stars (or forks, open_issues, last_updated) serves the repos
+//     in the order of the corresponding view. ?wrap=search wraps the repos like a github
+//     search response, as {"total_count":N,"incomplete_results":false,"items":[...]}.
+//     ?visibility=public or ?visibility=private serves only the public or the private
+//     repos, which the cache holds when the token has access to them.
+//     /orgs/<org>/members accepts ?sort=login to sort the members by login, and
+//     ?role=admin or ?role=member to serve only the org owners or the other members,
+//     which fails with 503 when the token can't list the owners.
+//     The views and /orgs/<org>/repos report the repos refresh they were derived from in
+//     the X-Cache-Generation header.
+// (3) Provide an Atom feed of recently updated repos at
+//     /feed/updated
+//     and a download of the cached repos at
+//     /export/repos.json
+// (4) Expose the top repos' stars and forks as Prometheus gauges at
+//     /metrics
+// (5) Provide admin endpoints, all of which require the admin secret
+//     /admin/diff (paginated with ?limit= and ?offset=)
+//     /admin/stats
+//     /admin/maintenance
+//     /admin/loglevel
+//     /admin/pagination
+//     /admin/errors
+// (6) Proxies all other urls to github.
 
 
+// Github org whose data is cached unless another one is passed to NewServer.
+const DefaultOrg = "Netflix"
+
 // Useful constants for paths we will be serving.
 const (
-	kRouteHealthCheck     = "/healthcheck"
-	kGitHubRoot           = "/"
-	kGitHubNetflix        = "/orgs/Netflix"
-	kGitHubNetflixMembers = "/orgs/Netflix/members"
-	kGitHubNetflixRepos   = "/orgs/Netflix/repos"
-	kViews                = "/view/top/"
+	kRouteHealthCheck = "/healthcheck"
+	kRouteLivez       = "/livez"
+	kGitHubRoot       = "/"
+	kViewsRoot        = "/view/"
+	kViews            = "/view/top/"
+	kViewTopics       = "/view/topics"
+	kViewLanguages    = "/view/languages"
+	kViewHistory      = "/view/history/"
+	kFeedUpdated      = "/feed/updated"
+	kMetrics          = "/metrics"
+	kExportRepos      = "/export/repos.json"
+	kAdminDiff        = "/admin/diff"
+	kAdminStats       = "/admin/stats"
+	kAdminMaintenance = "/admin/maintenance"
+	kAdminLogLevel    = "/admin/loglevel"
+	kAdminPagination  = "/admin/pagination"
+	kAdminErrors      = "/admin/errors"
 )
 
+// Values of the views' time_format query param.
+const (
+	kTimeFormatRFC3339 = "rfc3339"
+	kTimeFormatUnix    = "unix"
+	kTimeFormatUnixMs  = "unixms"
+)
+
+// Values of the views' format query param.
+const (
+	kFormatJSON = "json"
+	kFormatHTML = "html"
+)
+
+// Seconds a client is asked to wait before retrying a request that was shed.
+const kRetryAfterSecs = 1
+
 // viewElm caches netflix/repos fields that are required to satisfy the views API. We
 // keep sorted pointers (sorted by the view's sort attribute) to these in per-view sorted
 // lists.
 type viewElm struct {
-	name string
-	forks int
-	updated time.Time
+	id         int64
+	name       string
+	forks      int
+	updated    time.Time
 	openIssues int
-	stars int
+	stars      int
+	// SPDX ID of the repo's license, empty if github didn't detect one.
+	license string
+	// Name of the repo's default branch, empty if github reported none.
+	defaultBranch string
+	topics        []string
+	// Primary language, empty if github detected none.
+	language string
+	// Number of contributors, only fetched for the repos in topContributors.
+	contributors int
+}
+
+// memberElm caches a member's login along with its raw JSON object, so that the members
+// can be reordered without losing any of the fields github returned.
+type memberElm struct {
+	login string
+	raw   json.RawMessage
+	// Whether the member is an owner of the org.
+	admin bool
+}
+
+// Orders view elements whose view metric is equal. The views are sorted by their metric
+// (largest or most recent first), then by repo name (ascending), then by repo ID
+// (ascending). Since IDs are unique this is a total order, so the views' output is fully
+// determined by the cached data.
+func tieBreakLess(a *viewElm, b *viewElm) bool {
+	if a.name != b.name {
+		return a.name < b.name
+	}
+	return a.id < b.id
 }
 
 // The server object.
 type Server struct {
-	// Port on which to listen on.
+	// Port on which to listen on, 0 to not listen on TCP at all.
 	port uint32
-	// API token for getting around rate limiting. If this fields is non empty, then it's
-	// sent in the "Authorization" header for all GET requests to github.
-	apiToken string
+	// Tunable settings.
+	config *Config
+	// Github org whose data is cached, qualifying the repo names in the views.
+	org string
+	// Github paths of the org, its members, its repos, and the owners among its members,
+	// which are fetched along with the members. All but the owners are served from the cache.
+	orgPath     string
+	membersPath string
+	reposPath   string
+	adminsPath  string
+	// Semaphore capping the number of in-flight requests, nil if unlimited.
+	inflight chan struct{}
+	// API tokens for getting around rate limiting. If there are any, then they are sent
+	// in rotation in the "Authorization" header for all GET requests to github.
+	tokens *http_utils.TokenPool
+	// Per client IP rate limiter, nil if disabled.
+	rateLimiter *ipRateLimiter
+	// Cache of proxied responses, nil if disabled.
+	proxyCache *proxyCache
 	// Cache of cached paths to their bodies.
-	caches map[string][]byte
-	// Sorted slices of viewElm pointers for the various views.
-	topForks []*viewElm
-	lastUpdated []*viewElm
-	topOpenIssues []*viewElm
-	topStars []*viewElm
+	cache CacheBackend
+	// Function refreshing each cached path, see buildRefreshFns. The cached paths are fixed
+	// once the server is created.
+	refreshFns map[string]func(ctx context.Context)
+	// Shape of the latest successful fetch of each paginated cached path.
+	pagination map[string]paginationStats
+	// Latest error response of github for each fetched path.
+	fetchErrors map[string]fetchError
+	// Github API version each cached path was last refreshed with, see
+	// Config.GitHubAPIVersion. Paths whose version is unknown have no entry.
+	apiVersions map[string]string
+	// Time at which each cached path was last refreshed.
+	refreshedAt map[string]time.Time
+	// Time at which a refresh of each cached path was last started.
+	attemptedAt map[string]time.Time
+	// Time at which a refresh of each cached path last completed, successfully or not.
+	completedAt map[string]time.Time
+	// Whether the latest completed refresh of each cached path reached github.
+	reachedGitHub map[string]bool
+	// Whether the latest completed refreshes of all the cached paths reached github,
+	// reported by the JSON health check.
+	githubReachable bool
+	// Time at which a refresh last reached github.
+	githubLastSuccess time.Time
+	// Time at which the refresh loop of each cached path will next refresh it.
+	nextRefreshAt map[string]time.Time
+	// Cached paths whose refresh is running.
+	refreshing map[string]bool
+	// View elements of the cached repos in github's order, whatever the view metrics.
+	viewElms []*viewElm
+	// Sorted slices of viewElm pointers for the various views, nil for disabled metrics.
+	topForks        []*viewElm
+	lastUpdated     []*viewElm
+	topOpenIssues   []*viewElm
+	topStars        []*viewElm
+	topContributors []*viewElm
+	// Number of repos using each topic, most used first.
+	topicCounts []topicCount
+	// Number of repos with each primary language, most used first.
+	languageCounts []languageCount
+	// Cached repos in github's order.
+	repos []*github_types.Repository
+	// Cached members in github's order.
+	members []memberElm
+	// Whether the roles of the cached members are known, i.e. the owners could be fetched.
+	memberRolesKnown bool
+	// Aggregate metrics of the last repos refreshes, oldest first.
+	history []historyPoint
+	// Checksum of the cached repos, see reposChecksum.
+	reposChecksum string
+	// Number of successful repos refreshes, identifying the content of the views.
+	reposGeneration uint64
+	// Random identifier of this process, prefixed to the generation in the views' ETags
+	// since the generations of every process count from 1.
+	etagNonce string
+	// Snapshot of the view elements as of the previous repos refresh, keyed by name. Nil
+	// until the second refresh.
+	prevSnapshot map[string]viewElm
+
+	// Routes of the server, served on the TCP port and the unix socket.
+	mux *http.ServeMux
 
 	// Whether the server is ready to serve requests.
 	ready bool
-	// Lock to synchronize access to above fields.
-	lock sync.Mutex
-}
-
-// Construct a new server object.
-func NewServer(port uint32, apiToken string) *Server {
-	s := &Server{port:port, apiToken:apiToken, caches: make(map[string][]byte)}
-	http.HandleFunc(kRouteHealthCheck, createWrappedHandlerFn(s, handleHealthCheck))
-	http.HandleFunc(kGitHubRoot, createWrappedHandlerFn(s, handleRoot))
-	http.HandleFunc(kGitHubNetflix, createWrappedHandlerFn(s, handleNetflix))
-	http.HandleFunc(kGitHubNetflixMembers, createWrappedHandlerFn(s, handleNetflixMembers))
-	http.HandleFunc(kGitHubNetflixRepos, createWrappedHandlerFn(s, handleNetflixRepos))
-	http.HandleFunc(kViews, createWrappedHandlerFn(s, handleViews))
+	// Whether the watchdog found a cache that isn't being refreshed anymore.
+	stalled bool
+	// Whether maintenance mode is on.
+	maintenance bool
+	// Context of the refreshes, canceled by Stop to interrupt them.
+	ctx  context.Context
+	stop context.CancelFunc
+	// Minimum level of the messages logged, adjustable at runtime.
+	logLevel *slog.LevelVar
+	// Lock to synchronize access to above fields. It must never be held across network
+	// I/O: the refresh functions fetch all pages from github first and only take the lock
+	// to swap in the results, so that the handlers stay responsive during a slow refresh.
+	// Handlers that only read the fields take the read lock, so that they don't serialize.
+	lock sync.RWMutex
+	// Repos cache of the latest generation, read without the lock, see reposWithGeneration.
+	reposSnapshot atomic.Pointer[reposSnapshot]
+	// Time the latest request other than a probe was received, in Unix nanoseconds, see
+	// Config.IdleTimeout. Every request records it, so it is kept out of the lock.
+	lastRequestAt atomic.Int64
+}
+
+// Construct a new server object caching the data of the github org org, e.g. DefaultOrg.
+// apiToken may hold several comma separated tokens, which are then used in rotation. If
+// config is nil, the defaults are used.
+func NewServer(port uint32, apiToken string, org string, config *Config) *Server {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	tokens := http_utils.NewTokenPool(strings.Split(apiToken, ","))
+	http_utils.SetTimeouts(config.RefreshTimeout, config.ProxyTimeout)
+	http_utils.SetAPIVersion(config.GitHubAPIVersion)
+	http_utils.SetForwardedHeaders(config.ProxyResponseHeaders, config.ProxyHiddenHeaders)
+	http_utils.SetMaxConcurrentRequests(config.MaxGitHubConcurrency)
+	http_utils.SetMaxRateLimitWait(config.MaxRateLimitWait)
+	http_utils.SetClientTimeout(config.GitHubClientTimeout)
+	if config.StructuredErrors {
+		http_utils.SetErrorWriter(writeStructuredError)
+	} else {
+		http_utils.SetErrorWriter(http.Error)
+	}
+	s := &Server{port: port, tokens: tokens, config: config, mux: http.NewServeMux(), org: org,
+		orgPath: "/orgs/" + org, membersPath: "/orgs/" + org + "/members",
+		reposPath: "/orgs/" + org + "/repos", adminsPath: "/orgs/" + org + "/members?role=admin",
+		apiVersions: make(map[string]string), pagination: make(map[string]paginationStats),
+		fetchErrors: make(map[string]fetchError),
+		refreshedAt: make(map[string]time.Time),
+		attemptedAt: make(map[string]time.Time), completedAt: make(map[string]time.Time),
+		reachedGitHub: make(map[string]bool),
+		nextRefreshAt: make(map[string]time.Time), refreshing: make(map[string]bool),
+		logLevel: new(slog.LevelVar)}
+	s.ctx, s.stop = context.WithCancel(context.Background())
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	s.etagNonce = hex.EncodeToString(nonce)
+	s.refreshFns = s.buildRefreshFns()
+	if config.RedisAddr != "" {
+		s.cache = newRedisBackend(config.RedisAddr)
+	} else {
+		s.cache = newMemoryBackend()
+	}
+	// Config.LogLevel is validated by the caller, an invalid one leaves the info level.
+	s.logLevel.UnmarshalText([]byte(config.LogLevel))
+	setupLogging(s.logLevel)
+	if config.RateLimit > 0 {
+		s.rateLimiter = newIPRateLimiter(config.RateLimit, config.RateLimitBurst)
+	}
+	if config.ProxyCacheSize > 0 {
+		s.proxyCache = newProxyCache(config.ProxyCacheSize, config.ProxyCacheTTL)
+	}
+	if config.MaxConcurrentRequests > 0 {
+		s.inflight = make(chan struct{}, config.MaxConcurrentRequests)
+	}
+	s.mux.HandleFunc(kRouteHealthCheck, createWrappedHandlerFn(s, handleHealthCheck))
+	s.mux.HandleFunc(kRouteLivez, createWrappedHandlerFn(s, handleLivez))
+	s.mux.HandleFunc(kGitHubRoot, createWrappedHandlerFn(s, handleRoot))
+	s.mux.HandleFunc(s.orgPath, createWrappedHandlerFn(s, handleNetflix))
+	s.mux.HandleFunc(s.membersPath, createWrappedHandlerFn(s, handleNetflixMembers))
+	s.mux.HandleFunc(s.reposPath, createWrappedHandlerFn(s, handleNetflixRepos))
+	s.mux.HandleFunc(s.reposPath+kChecksumSuffix, createWrappedHandlerFn(s, handleReposChecksum))
+	for _, path := range config.ExtraCachedPaths {
+		s.mux.HandleFunc(path, createWrappedHandlerFn(s, extraPathHandler(path)))
+	}
+	if s.config.EnableViews {
+		s.mux.HandleFunc(kViews, createWrappedHandlerFn(s, handleViews))
+		s.mux.HandleFunc(kViewTopics, createWrappedHandlerFn(s, handleViewTopics))
+		s.mux.HandleFunc(kViewLanguages, createWrappedHandlerFn(s, handleViewLanguages))
+		s.mux.HandleFunc(kViewHistory, createWrappedHandlerFn(s, handleViewHistory))
+	} else {
+		// Keep the views' paths from falling through to the proxy.
+		s.mux.HandleFunc(kViewsRoot, createWrappedHandlerFn(s, handleViewsDisabled))
+	}
+	s.mux.HandleFunc(kFeedUpdated, createWrappedHandlerFn(s, handleFeedUpdated))
+	s.mux.HandleFunc(kMetrics, createWrappedHandlerFn(s, handleMetrics))
+	s.mux.HandleFunc(kExportRepos, createWrappedHandlerFn(s, handleExportRepos))
+	s.mux.HandleFunc(kAdminDiff, createWrappedHandlerFn(s, requireAdminSecret(handleAdminDiff)))
+	s.mux.HandleFunc(kAdminStats, createWrappedHandlerFn(s, requireAdminSecret(handleAdminStats)))
+	s.mux.HandleFunc(kAdminMaintenance, createWrappedHandlerFn(s, requireAdminSecret(handleAdminMaintenance)))
+	s.mux.HandleFunc(kAdminLogLevel, createWrappedHandlerFn(s, requireAdminSecret(handleAdminLogLevel)))
+	s.mux.HandleFunc(kAdminPagination, createWrappedHandlerFn(s, requireAdminSecret(handleAdminPagination)))
+	s.mux.HandleFunc(kAdminErrors, createWrappedHandlerFn(s, requireAdminSecret(handleAdminErrors)))
+	s.logConfig()
 	return s
 }
 
+// Logs a summary of the effective configuration. The api tokens themselves are never
+// logged, only how many were provided.
+func (s *Server) logConfig() {
+	active, _ := s.tokens.Counts()
+	slog.Info("Starting",
+		"port", s.port,
+		"org", s.org,
+		"base_url", http_utils.BaseURL,
+		"tokens", active,
+		"refresh_interval", s.config.RefreshInterval,
+		"refresh_intervals", s.config.RefreshIntervals,
+		"empty_view_status", s.config.EmptyViewStatus,
+		"max_concurrent_requests", s.config.MaxConcurrentRequests,
+		"exclude_archived", s.config.ExcludeArchived,
+		"contributors_top_k", s.config.ContributorsTopK,
+		"unix_socket", s.config.UnixSocket,
+		"validate_json", s.config.ValidateJSON,
+		"metrics_top_k", s.config.MetricsTopK,
+		"compress_min_bytes", s.config.CompressMinBytes,
+		"watchdog_intervals", s.config.WatchdogIntervals,
+		"watchdog_fails_health", s.config.WatchdogFailsHealth,
+		"access_log", s.config.AccessLog,
+		"proxy_cache_size", s.config.ProxyCacheSize,
+		"proxy_cache_ttl", s.config.ProxyCacheTTL,
+		"cache_ttls", s.config.CacheTTLs,
+		"max_request_body_bytes", s.config.MaxRequestBodyBytes,
+		"snapshot_file", s.config.SnapshotFile,
+		"rate_limit", s.config.RateLimit,
+		"rate_limit_burst", s.config.RateLimitBurst,
+		"tls", s.config.TLSCertFile != "",
+		"mtls", s.config.TLSClientCAFile != "",
+		"extra_cached_paths", s.config.ExtraCachedPaths,
+		"history_size", s.config.HistorySize,
+		"proxy_force_json", s.config.ProxyForceJSON,
+		"idle_timeout", s.config.IdleTimeout,
+		"max_repo_drop_percent", s.config.MaxRepoDropPercent,
+		"refresh_timeout", s.config.RefreshTimeout,
+		"proxy_timeout", s.config.ProxyTimeout,
+		"log_level", s.logLevel.Level(),
+		"admin_secret", s.config.AdminSecret != "",
+		"github_api_version", s.config.GitHubAPIVersion,
+		"redis_addr", s.config.RedisAddr,
+		"follower", s.config.Follower,
+		"members_max_pages", s.config.MembersMaxPages,
+		"prefetch_pages", s.config.PrefetchPages,
+		"proxy_cache_normalize_keys", s.config.ProxyCacheNormalizeKeys,
+		"enable_views", s.config.EnableViews,
+		"default_view_count", s.config.DefaultViewCount,
+		"proxy_response_headers", s.config.ProxyResponseHeaders,
+		"proxy_hidden_headers", s.config.ProxyHiddenHeaders,
+		"max_github_concurrency", s.config.MaxGitHubConcurrency,
+		"healthcheck_views", s.config.HealthCheckViews,
+		"max_rate_limit_wait", s.config.MaxRateLimitWait,
+		"structured_errors", s.config.StructuredErrors,
+		"github_max_attempts", s.config.GitHubMaxAttempts,
+		"github_retry_base_delay", s.config.GitHubRetryBaseDelay,
+		"view_metrics", s.config.ViewMetrics,
+		"github_client_timeout", s.config.GitHubClientTimeout)
+}
+
 // Creates a callback function suitable for passing into golang's http.HandleFunc() method
 // that also binds the server object along with it.
 func createWrappedHandlerFn(s *Server, fn func(s *Server, w http.ResponseWriter,
 	r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.AccessLog != AccessLogOff {
+			start := time.Now()
+			var info *requestInfo
+			r, info = withRequestInfo(r)
+			sr := &statusRecorder{ResponseWriter: w}
+			w = sr
+			defer func() {
+				s.logAccess(r, sr.status, info, time.Since(start))
+			}()
+		}
+		s.touch(r.URL.Path)
+		if !s.checkClientCert(w, r) {
+			return
+		}
+		if !s.checkRateLimit(w, r) {
+			return
+		}
+		// Refuse everything but the probes and admin endpoints in maintenance mode.
+		if !servedInMaintenance(r.URL.Path) {
+			s.lock.RLock()
+			maintenance := s.maintenance
+			s.lock.RUnlock()
+			if maintenance {
+				w.Header().Set("Retry-After", strconv.Itoa(kMaintenanceRetryAfterSecs))
+				s.writeError(w, "Down for maintenance", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		// Shed load if the cap on in-flight requests has been reached rather than queueing.
+		// Liveness probes are never shed, lest an overloaded process gets restarted.
+		if s.inflight != nil && r.URL.Path != kRouteLivez {
+			select {
+			case s.inflight <- struct{}{}:
+				defer func() { <-s.inflight }()
+			default:
+				w.Header().Set("Retry-After", strconv.Itoa(kRetryAfterSecs))
+				s.writeError(w, "Too many concurrent requests", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		// Read the body upfront under the size limit, so that oversized bodies are refused
+		// before they are proxied to github.
+		if s.config.MaxRequestBodyBytes > 0 && r.Body != nil && r.Body != http.NoBody {
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.config.MaxRequestBodyBytes))
+			if err != nil {
+				s.writeError(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		s.revalidateIfExpired(r.URL.Path)
+		// Tell which github API version cached data came from.
+		s.lock.RLock()
+		version := s.apiVersions[r.URL.Path]
+		s.lock.RUnlock()
+		if version != "" {
+			w.Header().Set("X-GitHub-Api-Version", version)
+		}
+		s.setFreshnessHeaders(w, r.URL.Path, time.Now())
+		// Proxied responses are streamed rather than buffered. They are compressed by github
+		// if the client accepts it, since its Accept-Encoding is forwarded.
+		if s.config.CompressMinBytes >= 0 && !s.proxies(r) {
+			bw := &bufferedResponseWriter{ResponseWriter: w}
+			fn(s, bw, r)
+			s.writeCompressed(w, r, bw)
+			return
+		}
 		fn(s, w, r)
 	}
 }
 
+// Wraps fn, the handler of an admin endpoint, so that it requires the admin secret, see
+// checkAdminSecret.
+func requireAdminSecret(fn func(s *Server, w http.ResponseWriter,
+	r *http.Request)) func(s *Server, w http.ResponseWriter, r *http.Request) {
+	return func(s *Server, w http.ResponseWriter, r *http.Request) {
+		if s.checkAdminSecret(w, r) {
+			fn(s, w, r)
+		}
+	}
+}
+
+// Returns whether r is proxied to github rather than served from the caches.
+func (s *Server) proxies(r *http.Request) bool {
+	_, pattern := s.mux.Handler(r)
+	return pattern == kGitHubRoot && r.URL.Path != kGitHubRoot
+}
+
+// Serves r with the server's routes, so that the server can be served by any http.Server.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
 // Run the server. This method doesn't return.
 func (s *Server) Run() {
 	// Start the server to handle HTTP requests in a gofunc.
-	go func() {
-		http.ListenAndServe(fmt.Sprintf(":%v", s.port), nil)
-	}()
+	if s.port != 0 && s.config.TLSCertFile != "" {
+		go s.listenAndServeTLS()
+	} else if s.port != 0 {
+		go func() {
+			http.ListenAndServe(fmt.Sprintf(":%v", s.port), s)
+		}()
+	}
+	if s.config.UnixSocket != "" {
+		s.listenUnix()
+	}
+	// Exit once idle, counting from startup.
+	if s.config.IdleTimeout > 0 {
+		s.lastRequestAt.Store(time.Now().UnixNano())
+		go s.idleLoop()
+	}
+	// Serve the snapshot, if any, without ever refreshing.
+	if s.offline() {
+		s.loadSnapshot()
+		s.markReady()
+		select {}
+	}
+	// Watch the refreshes, including the first one, for stalls.
+	if s.config.WatchdogIntervals > 0 {
+		go s.watchdogLoop(time.Now())
+	}
 
-	// Loop forever, refreshing the caches every 5 minutes.
+	// Populate all caches once, then keep refreshing each cache in its own loop so that
+	// every cache can be refreshed at its own interval.
+	s.refreshCaches()
+	for path, refresh := range s.refreshFns {
+		go s.refreshLoop(path, refresh)
+	}
+	// Block forever.
+	select {}
+}
+
+// Stops refreshing the caches. Refreshes in progress are interrupted, without committing
+// any partial results, and no further refreshes are started. The caches keep being served
+// as they are.
+func (s *Server) Stop() {
+	s.stop()
+}
+
+// Returns the function refreshing each cached path.
+func (s *Server) buildRefreshFns() map[string]func(ctx context.Context) {
+	// Followers only rebuild their in-memory state from the shared backend, the other
+	// caches are served from the backend as they are.
+	if s.config.Follower {
+		return map[string]func(ctx context.Context){
+			s.reposPath:   s.reloadRepos,
+			s.membersPath: s.reloadMembers,
+		}
+	}
+	fns := map[string]func(ctx context.Context){
+		kGitHubRoot:   s.refreshRoot,
+		s.orgPath:     s.refreshNetflix,
+		s.reposPath:   s.refreshNetflixRepos,
+		s.membersPath: s.refreshNetflixMembers,
+	}
+	for _, path := range s.config.ExtraCachedPaths {
+		path := path
+		fns[path] = func(ctx context.Context) { s.refreshExtraPath(ctx, path) }
+	}
+	return fns
+}
+
+// Loop until the server is stopped, refreshing a single cache at its configured interval.
+// Refreshes are scheduled on a fixed cadence rather than an interval after the previous
+// one ended, so that slow refreshes don't make the schedule drift. Ticks that fall while a
+// refresh of the cache is still running are skipped rather than stacked.
+func (s *Server) refreshLoop(path string, refresh func(ctx context.Context)) {
+	interval := s.config.refreshIntervalFor(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	next := time.Now().Add(interval)
 	for {
-		s.refreshCaches()
-		time.Sleep(time.Minute * 5)
+		s.lock.Lock()
+		s.nextRefreshAt[path] = next
+		s.lock.Unlock()
+		slog.Debug(fmt.Sprintf("Next refresh of %v scheduled at %v", path, next.Format(time.RFC3339)))
+		var tick time.Time
+		select {
+		case tick = <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+		next = tick.Add(interval)
+		// Another refresh, e.g. an on-access revalidation, may be running.
+		if !s.refreshOnce(path, refresh) {
+			log.Printf("Skipping refresh of %v, previous refresh still running", path)
+			continue
+		}
+		// The ticker keeps a single tick that fell during the refresh, drop it.
+		select {
+		case <-ticker.C:
+			log.Printf("Skipping refresh of %v, previous refresh ran longer than %v",
+				path, interval)
+			next = next.Add(interval)
+		default:
+		}
 	}
 }
 
-// Refresh the cached APIs.
+// Refresh all the cached APIs.
 func (s *Server) refreshCaches() {
 	// Refresh all caches in parallel.
 	var wg sync.WaitGroup
-	wg.Add(4)
-	go func() {
-		defer wg.Done()
-		s.refreshRoot()
-	}()
-	go func() {
-		defer wg.Done()
-		s.refreshNetflix()
-	}()
-	go func() {
-		defer wg.Done()
-		s.refreshNetflixRepos()
-	}()
-	go func() {
-		defer wg.Done()
-		s.refreshNetflixMembers()
-	}()
+	for path, refresh := range s.refreshFns {
+		wg.Add(1)
+		go func(path string, refresh func(ctx context.Context)) {
+			defer wg.Done()
+			s.refreshOnce(path, refresh)
+		}(path, refresh)
+	}
 	wg.Wait()
-	// Mark ourselves ready after the first cache update. Even though s.ready is a single
-	// bool, and updates to it should be inherently atomic, we perform the update under a
-	// lock to ensure that the update invalidates cache lines on all cpus. This is because
-	// the readycheck handler may be running on a different cpu.
+	s.markReady()
+}
+
+// Mark ourselves ready after the first cache update. Even though s.ready is a single bool,
+// and updates to it should be inherently atomic, we perform the update under a lock to
+// ensure that the update invalidates cache lines on all cpus. This is because the
+// readycheck handler may be running on a different cpu.
+func (s *Server) markReady() {
 	if !s.ready {
 		// Update s.ready under a lock to flush it to main memory and invalidate it in
 		// the cache lines, ensuring other goroutines running on other cpus see the change.
@@ -143,172 +653,995 @@ func (s *Server) refreshCaches() {
 	}
 }
 
+// Returns the policy of the retries of the requests to github fetching the caches.
+func (s *Server) retryPolicy() http_utils.RetryPolicy {
+	return http_utils.RetryPolicy{MaxAttempts: s.config.GitHubMaxAttempts,
+		BaseDelay: s.config.GitHubRetryBaseDelay}
+}
+
 // Helper functions to refresh the various caches.
-func (s *Server) refreshRoot() {
-	g := http_utils.NewPagedGet(kGitHubRoot, s.apiToken)
+func (s *Server) refreshRoot(ctx context.Context) {
+	g := http_utils.NewPagedGet(kGitHubRoot, s.tokens, s.retryPolicy())
 	// NOTE: we expect only a single page for this url.
-	body, _ := g.GetPage()
+	body, _, err := g.GetPage(ctx)
+	if err != nil {
+		log.Printf("Failed to refresh root cache, err=%v", err)
+		s.recordUnreachable(ctx, err)
+		s.recordFetchError(kGitHubRoot, err)
+		return
+	}
+	if !s.acceptBody(kGitHubRoot, body) {
+		return
+	}
+	if !s.setCache(kGitHubRoot, body) {
+		return
+	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	s.caches[kGitHubRoot] = body
+	s.setAPIVersion(kGitHubRoot, g.APIVersion())
+	s.refreshedAt[kGitHubRoot] = time.Now()
 	log.Printf("Refreshed root cache")
 }
 
-func (s *Server) refreshNetflix() {
-	g := http_utils.NewPagedGet(kGitHubNetflix, s.apiToken)
+func (s *Server) refreshNetflix(ctx context.Context) {
+	g := http_utils.NewPagedGet(s.orgPath, s.tokens, s.retryPolicy())
 	// NOTE: we expect only a single page for this url.
-	body, _ := g.GetPage()
+	body, _, err := g.GetPage(ctx)
+	if err != nil {
+		log.Printf("Failed to refresh %v cache, err=%v", s.orgPath, err)
+		s.recordUnreachable(ctx, err)
+		s.recordFetchError(s.orgPath, err)
+		return
+	}
+	if !s.acceptBody(s.orgPath, body) {
+		return
+	}
+	if !s.setCache(s.orgPath, body) {
+		return
+	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	s.caches[kGitHubNetflix] = body
-	log.Printf("Refreshed orgs/netflix cache")
+	s.setAPIVersion(s.orgPath, g.APIVersion())
+	s.refreshedAt[s.orgPath] = time.Now()
+	log.Printf("Refreshed %v cache", s.orgPath)
 }
 
-func (s *Server) refreshNetflixRepos() {
-	g := http_utils.NewPagedGet(kGitHubNetflixRepos, s.apiToken)
+func (s *Server) refreshNetflixRepos(ctx context.Context) {
 	// NOTE: we expect multiple pages for this url. In order to flatten them into a single
-	// page, we read, deserialize and append repos from each page into a single slice and
-	// then serialize the slice into a single serialized json.
-	next := true
+	// page, we deserialize the repos of all pages into a single slice and then serialize
+	// the slice into a single serialized json.
+	items, apiVersion, err := s.fetchAllPages(ctx, s.reposPath, 0)
+	if err != nil {
+		log.Printf("Failed to refresh %v cache, err=%v", s.reposPath, err)
+		return
+	}
+	repos := make([]*github_types.Repository, 0, len(items))
+	for _, item := range items {
+		// A null item decodes into a nil repo, which ingestRepos skips.
+		var repo *github_types.Repository
+		if err := json.Unmarshal(item, &repo); err != nil {
+			log.Printf("Failed to decode %v item, err=%v", s.reposPath, err)
+			continue
+		}
+		repos = append(repos, repo)
+	}
+	log.Printf("Number of netflix repos %v", len(repos))
+	s.ingestRepos(ctx, repos, apiVersion)
+}
+
+// Swaps a freshly fetched list of repos into the repos cache and rebuilds the views from
+// it. apiVersion is the github API version the repos were fetched with, empty if unknown.
+// Nothing is swapped in if ctx is canceled meanwhile.
+func (s *Server) ingestRepos(ctx context.Context, fetched []*github_types.Repository,
+	apiVersion string) {
+	excluded := 0
 	var elms []*viewElm
 	var repos []*github_types.Repository
-	for next {
-		var body []byte
-		// Get body for the next page.
-		body, next = g.GetPage()
-		// Deserialize into repos.
-		var pageRepos []*github_types.Repository
-		json.Unmarshal(body, &pageRepos)
-		// Process each repo.
-		for _, r := range pageRepos {
-			// Append to single slice for flattening later.
-			repos = append(repos, r)
-			// Create view element.
-			ve := &viewElm{name:*r.Name, forks:*r.ForksCount, updated:r.UpdatedAt.Time,
-				openIssues:*r.OpenIssuesCount, stars:*r.StargazersCount}
-			elms = append(elms, ve)
-		}
-		fmt.Printf("Number of netflix repos %v\n", len(repos))
-	}
-
-	// Once we have gathered all pages, we can lock to update the cache, and update the
-	// sorted views.
+	// Process each repo.
+	for _, r := range fetched {
+		// Malformed upstream arrays may hold null entries.
+		if r == nil {
+			log.Printf("Skipping null entry in %v", s.reposPath)
+			continue
+		}
+		// Entries lacking fields, e.g. in hand-written snapshot files, would crash the views.
+		if field := missingRepoField(r); field != "" {
+			log.Printf("Skipping entry without %v in %v", field, s.reposPath)
+			continue
+		}
+		// Drop archived and disabled repos if so configured.
+		if s.config.ExcludeArchived && ((r.Archived != nil && *r.Archived) ||
+			(r.Disabled != nil && *r.Disabled)) {
+			excluded++
+			continue
+		}
+		repos = append(repos, r)
+		if !s.config.EnableViews {
+			continue
+		}
+		// Create view element.
+		ve := &viewElm{id: *r.ID, name: *r.Name, forks: *r.ForksCount, updated: r.UpdatedAt.Time,
+			openIssues: *r.OpenIssuesCount, stars: *r.StargazersCount}
+		if r.License != nil && r.License.SPDXID != nil {
+			ve.license = *r.License.SPDXID
+		}
+		if r.DefaultBranch != nil {
+			ve.defaultBranch = *r.DefaultBranch
+		}
+		ve.topics = r.Topics
+		if r.Language != nil {
+			ve.language = *r.Language
+		}
+		elms = append(elms, ve)
+	}
+	if s.config.ExcludeArchived {
+		log.Printf("Excluded %v archived or disabled repos", excluded)
+	}
+	// Keep the stale cache rather than a dramatically smaller one, which is more likely to
+	// come from a truncated response than from repos actually being deleted.
+	if s.config.MaxRepoDropPercent > 0 {
+		s.lock.RLock()
+		prevCount := len(s.repos)
+		s.lock.RUnlock()
+		if prevCount > 0 && (prevCount-len(repos))*100 > prevCount*s.config.MaxRepoDropPercent {
+			slog.Error(fmt.Sprintf("Rejecting refresh of %v, repo count dropped from %v to %v, "+
+				"more than %v%%", s.reposPath, prevCount, len(repos),
+				s.config.MaxRepoDropPercent))
+			return
+		}
+	}
+	// Fetch contributor counts, if enabled, before taking the lock. There is no github
+	// access when serving a snapshot, and followers use the counts fetched by the instance
+	// refreshing from github.
+	var contributors []*viewElm
+	fetchedContributors := false
+	if s.config.EnableViews && s.config.viewMetricEnabled("contributors") {
+		if s.config.Follower {
+			contributors = s.loadContributors(elms)
+		} else if !s.offline() {
+			contributors = s.fetchContributors(ctx, elms)
+			fetchedContributors = true
+		}
+	}
+	// Don't commit partial contributor counts.
+	if ctx.Err() != nil {
+		log.Printf("Abandoning refresh of %v cache, err=%v", s.reposPath, ctx.Err())
+		return
+	}
+	if fetchedContributors {
+		s.storeContributors(contributors)
+	}
+	var topicCounts []topicCount
+	var languageCounts []languageCount
+	if s.config.EnableViews {
+		topicCounts = countTopics(elms)
+		languageCounts = countLanguages(elms)
+	}
+	// Serialize the flattened repos. Followers rebuild the views from the backend's repos,
+	// which they must leave alone, but serialize them anyway for the checksum.
+	body, _ := json.Marshal(repos)
+	checksum := reposChecksum(body)
+	if !s.config.Follower && !s.setCache(s.reposPath, body) {
+		return
+	}
+
+	// Build the per-view sorted slices before taking the lock, so that views keep being
+	// served from the previous slices while they are sorted. The published slices are never
+	// modified, and are only swapped for new ones. Disabled metrics are left nil.
+	var topForks, lastUpdated, topOpenIssues, topStars []*viewElm
+	if s.config.EnableViews && s.config.viewMetricEnabled("forks") {
+		topForks = s.sortedView("forks", checksum, elms, lessForks)
+	}
+	if s.config.EnableViews && s.config.viewMetricEnabled("last_updated") {
+		lastUpdated = s.sortedView("last_updated", checksum, elms, lessLastUpdated)
+	}
+	if s.config.EnableViews && s.config.viewMetricEnabled("open_issues") {
+		topOpenIssues = s.sortedView("open_issues", checksum, elms, lessOpenIssues)
+	}
+	if s.config.EnableViews && s.config.viewMetricEnabled("stars") {
+		topStars = s.sortedView("stars", checksum, elms, lessStars)
+	}
+	if s.config.EnableViews && !s.config.Follower {
+		s.storeViews(checksum, map[string][]*viewElm{"forks": topForks,
+			"last_updated": lastUpdated, "open_issues": topOpenIssues, "stars": topStars})
+	}
+
+	// Once we have gathered all pages and built the views, we can lock to swap them in.
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	// Serialize the flattened repos.
-	s.caches[kGitHubNetflixRepos], _ = json.Marshal(repos)
-
-	// Clear the per-view sorted slices before refreshing them.
-	s.topForks = s.topForks[:0]
-	s.lastUpdated = s.lastUpdated[:0]
-	s.topOpenIssues = s.topOpenIssues[:0]
-	s.topStars = s.topStars[:0]
-	// Refresh the per-view sorted slices.
+	s.repos = repos
+	s.setAPIVersion(s.reposPath, apiVersion)
+	s.reposGeneration++
+	s.reposChecksum = checksum
+	s.reposSnapshot.Store(&reposSnapshot{body: body, generation: s.reposGeneration,
+		checksum: checksum})
+	totalStars := 0
 	for _, ve := range elms {
-		s.topForks = append(s.topForks, ve)
-		s.lastUpdated = append(s.lastUpdated, ve)
-		s.topOpenIssues = append(s.topOpenIssues, ve)
-		s.topStars = append(s.topStars, ve)
-	}
-	sort.Slice(s.topForks, func(i, j int) bool {
-		return s.topForks[i].forks > s.topForks[j].forks
-	})
-	sort.Slice(s.lastUpdated, func(i, j int) bool {
-		return s.lastUpdated[i].updated.After(s.lastUpdated[j].updated)
-	})
-	sort.Slice(s.topOpenIssues, func(i, j int) bool {
-		return s.topOpenIssues[i].openIssues > s.topOpenIssues[j].openIssues
-	})
-	sort.Slice(s.topStars, func(i, j int) bool {
-		return s.topStars[i].stars > s.topStars[j].stars
-	})
-	log.Printf("Refreshed orgs/netflix/repos cache")
-}
-
-func (s *Server) refreshNetflixMembers() {
-	g := http_utils.NewPagedGet(kGitHubNetflixMembers, s.apiToken)
-	body, _ := g.GetPage()
+		totalStars += ve.stars
+	}
+	s.refreshedAt[s.reposPath] = time.Now()
+	if !s.config.EnableViews {
+		log.Printf("Refreshed %v cache", s.reposPath)
+		return
+	}
+	s.recordHistory(historyPoint{at: s.refreshedAt[s.reposPath],
+		repoCount: len(elms), totalStars: totalStars})
+
+	// Retain the outgoing snapshot for /admin/diff. The first refresh has none.
+	if s.reposGeneration > 1 {
+		s.prevSnapshot = snapshotOf(s.viewElms)
+	}
+	s.viewElms = elms
+	s.topForks = topForks
+	s.lastUpdated = lastUpdated
+	s.topOpenIssues = topOpenIssues
+	s.topStars = topStars
+	s.topContributors = contributors
+	s.topicCounts = topicCounts
+	s.languageCounts = languageCounts
+	log.Printf("Refreshed %v cache", s.reposPath)
+}
+
+// Returns the name of the first field that the views and routes need but r lacks, empty if
+// r has them all. Github always sets them.
+func missingRepoField(r *github_types.Repository) string {
+	switch {
+	case r.ID == nil:
+		return "id"
+	case r.Name == nil:
+		return "name"
+	case r.ForksCount == nil:
+		return "forks_count"
+	case r.OpenIssuesCount == nil:
+		return "open_issues_count"
+	case r.StargazersCount == nil:
+		return "stargazers_count"
+	case r.UpdatedAt == nil:
+		return "updated_at"
+	}
+	return ""
+}
+
+// Returns the view of metric, elms sorted by less. Followers take the order of the view
+// stored in the cache backend for the repos of the given checksum, and only sort elms
+// themselves if there is none.
+func (s *Server) sortedView(metric string, checksum string, elms []*viewElm,
+	less func(a, b *viewElm) bool) []*viewElm {
+	if s.config.Follower {
+		if sorted := s.loadView(metric, checksum, elms); sorted != nil {
+			return sorted
+		}
+	}
+	return sortedViewElms(elms, less)
+}
+
+// Returns a new slice of elms sorted by less. The comparators define a total order, see
+// tieBreakLess.
+func sortedViewElms(elms []*viewElm, less func(a, b *viewElm) bool) []*viewElm {
+	sorted := make([]*viewElm, len(elms))
+	copy(sorted, elms)
+	sort.Slice(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+	return sorted
+}
+
+// Orders of the view elements by decreasing metric, see sortedViewElms.
+func lessForks(a, b *viewElm) bool {
+	if a.forks != b.forks {
+		return a.forks > b.forks
+	}
+	return tieBreakLess(a, b)
+}
+
+func lessLastUpdated(a, b *viewElm) bool {
+	if !a.updated.Equal(b.updated) {
+		return a.updated.After(b.updated)
+	}
+	return tieBreakLess(a, b)
+}
+
+func lessOpenIssues(a, b *viewElm) bool {
+	if a.openIssues != b.openIssues {
+		return a.openIssues > b.openIssues
+	}
+	return tieBreakLess(a, b)
+}
+
+func lessStars(a, b *viewElm) bool {
+	if a.stars != b.stars {
+		return a.stars > b.stars
+	}
+	return tieBreakLess(a, b)
+}
+
+// Returns sorted, or if its metric isn't precomputed, a new slice of elms sorted by less.
+func sortedOnDemand(sorted []*viewElm, elms []*viewElm,
+	less func(a, b *viewElm) bool) []*viewElm {
+	if sorted != nil {
+		return sorted
+	}
+	return sortedViewElms(elms, less)
+}
+
+func (s *Server) refreshNetflixMembers(ctx context.Context) {
+	items, apiVersion, err := s.fetchAllPages(ctx, s.membersPath, s.config.MembersMaxPages)
+	if err != nil {
+		log.Printf("Failed to refresh %v cache, err=%v", s.membersPath, err)
+		return
+	}
+	// Flatten the pages into a single array.
+	if items == nil {
+		items = []json.RawMessage{}
+	}
+	body, _ := json.Marshal(items)
+	// The members listing has no role, so fetch the owners separately. Tokens without the
+	// org admin scope can't list them, in which case the members are still cached, with
+	// their roles unknown, which is stored as null for followers.
+	admins, _, err := s.fetchAllPages(ctx, s.adminsPath, s.config.MembersMaxPages)
+	if admins == nil {
+		admins = []json.RawMessage{}
+	}
+	adminsBody, _ := json.Marshal(admins)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Failed to fetch the owners among %v, caching the members with "+
+			"unknown roles, err=%v", s.membersPath, err))
+		adminsBody = []byte("null")
+	}
+	if !s.setCache(s.adminsPath, adminsBody) || !s.setCache(s.membersPath, body) {
+		return
+	}
+	s.ingestMembers(body, adminsBody, apiVersion)
+}
+
+// Rebuilds the members from freshly cached bodies of members and of the admins among them.
+// adminsBody is nil or null if the admins are unknown, in which case so are the members'
+// roles. apiVersion is the github API version they were fetched with, empty if unknown.
+func (s *Server) ingestMembers(body []byte, adminsBody []byte, apiVersion string) {
+	rolesKnown := len(adminsBody) > 0 && string(adminsBody) != "null"
+	var adminUsers []github_types.User
+	json.Unmarshal(adminsBody, &adminUsers)
+	admins := make(map[string]bool, len(adminUsers))
+	for _, u := range adminUsers {
+		if u.Login != nil {
+			admins[*u.Login] = true
+		}
+	}
+	// Deserialize the members, keeping each one's raw object.
+	var raws []json.RawMessage
+	json.Unmarshal(body, &raws)
+	members := make([]memberElm, 0, len(raws))
+	for _, raw := range raws {
+		var m github_types.User
+		json.Unmarshal(raw, &m)
+		me := memberElm{raw: raw}
+		if m.Login != nil {
+			me.login = *m.Login
+			me.admin = admins[me.login]
+		}
+		members = append(members, me)
+	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	s.caches[kGitHubNetflixMembers] = body
-	log.Printf("Refreshed orgs/netflix/members cache")
+	s.setAPIVersion(s.membersPath, apiVersion)
+	s.members = members
+	s.memberRolesKnown = rolesKnown
+	s.refreshedAt[s.membersPath] = time.Now()
+	log.Printf("Refreshed %v cache", s.membersPath)
+}
+
+// Records the github API version the cache of path was refreshed with. Must be called
+// with the lock held.
+func (s *Server) setAPIVersion(path string, version string) {
+	if version == "" {
+		delete(s.apiVersions, path)
+	} else {
+		s.apiVersions[path] = version
+	}
+}
+
+// Returns whether a body fetched from github may be accepted into the cache for path. If
+// JSON validation is enabled, invalid bodies (e.g. truncated responses) are rejected so
+// that the stale cache keeps being served.
+func (s *Server) acceptBody(path string, body []byte) bool {
+	if !s.config.ValidateJSON || json.Valid(body) {
+		return true
+	}
+	log.Printf("Rejecting invalid JSON fetched for %v, keeping stale cache", path)
+	return false
 }
 
 // HTTP handler functions.
+
+// Liveness probe, which succeeds as long as the process serves HTTP. Unlike the readiness
+// probe at /healthcheck, it doesn't depend on the caches and never takes the lock.
+func handleLivez(s *Server, w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
 func handleHealthCheck(s *Server, w http.ResponseWriter, r *http.Request) {
-	s.lock.Lock()
+	s.lock.RLock()
 	ready := s.ready
-	s.lock.Unlock()
-	if ready {
-		w.WriteHeader(http.StatusOK)
-	} else {
-		w.WriteHeader(http.StatusServiceUnavailable)
+	if s.stalled && s.config.WatchdogFailsHealth {
+		ready = false
 	}
+	if ready && s.config.HealthCheckViews && !s.viewsConsistent() {
+		ready = false
+	}
+	s.lock.RUnlock()
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeHealthJSON(s, w, status)
+		return
+	}
+	w.WriteHeader(status)
 }
 
 func handleRoot(s *Server, w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "/" {
-		s.lock.Lock()
-		body := make([]byte, len(s.caches[kGitHubRoot]))
-		copy(body, s.caches[kGitHubRoot])
-		s.lock.Unlock()
+		body := s.getCache(kGitHubRoot)
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		w.Write(body)
+	} else if s.offline() {
+		s.writeError(w, "Not available when serving a snapshot", http.StatusNotFound)
+	} else if s.proxyCache != nil && r.Method == "GET" && r.Header.Get("Authorization") == "" {
+		s.forwardCached(w, r)
 	} else {
-		http_utils.Forward(w, r)
+		markProxied(r)
+		if err := http_utils.Forward(w, r, s.config.ProxyForceJSON); err != nil {
+			log.Printf("Proxied request failed, err=%v", err)
+		}
 	}
 }
 
 func handleNetflix(s *Server, w http.ResponseWriter, r *http.Request) {
-	s.lock.Lock()
-	body := make([]byte, len(s.caches[kGitHubNetflix]))
-	copy(body, s.caches[kGitHubNetflix])
-	s.lock.Unlock()
+	body := s.getCache(s.orgPath)
+	s.lock.RLock()
+	var repoCount, stars, forks, openIssues int
+	if r.URL.Query().Get("extras") == "true" {
+		repoCount = len(s.viewElms)
+		for _, ve := range s.viewElms {
+			stars += ve.stars
+			forks += ve.forks
+			openIssues += ve.openIssues
+		}
+	}
+	s.lock.RUnlock()
+	if r.URL.Query().Get("extras") == "true" {
+		// Merge the computed fields into the org object, keeping all of github's fields.
+		var org map[string]interface{}
+		if err := json.Unmarshal(body, &org); err != nil {
+			s.writeError(w, "Org cache isn't populated yet", http.StatusServiceUnavailable)
+			return
+		}
+		org["cached_repos"] = repoCount
+		org["total_stars"] = stars
+		org["total_forks"] = forks
+		org["total_open_issues"] = openIssues
+		body, _ = json.Marshal(org)
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Write(body)
 }
 
 func handleNetflixRepos(s *Server, w http.ResponseWriter, r *http.Request) {
-	s.lock.Lock()
-	body := make([]byte, len(s.caches[kGitHubNetflixRepos]))
-	copy(body, s.caches[kGitHubNetflixRepos])
-	s.lock.Unlock()
+	visibility := r.URL.Query().Get("visibility")
+	if visibility != "" && visibility != "all" && visibility != "public" &&
+		visibility != "private" {
+		s.writeError(w, fmt.Sprintf("Unknown visibility %q, valid visibilities are: all, public, "+
+			"private", visibility), http.StatusBadRequest)
+		return
+	}
+	if visibility == "public" || visibility == "private" {
+		handleNetflixReposByVisibility(s, w, r, visibility == "private")
+		return
+	}
+	if r.URL.Query().Get("names_only") == "true" {
+		handleNetflixRepoNames(s, w, r)
+		return
+	} else if r.URL.Query().Get("fields") != "" {
+		handleNetflixRepoFields(s, w, r)
+		return
+	} else if r.URL.Query().Get("sort") != "" {
+		handleNetflixReposSorted(s, w, r)
+		return
+	} else if wrap := r.URL.Query().Get("wrap"); wrap == "search" {
+		handleNetflixReposSearchWrapped(s, w, r)
+		return
+	} else if wrap != "" {
+		s.writeError(w, fmt.Sprintf("Unknown wrap %q, the only valid wrap is search", wrap),
+			http.StatusBadRequest)
+		return
+	}
+	body, generation := s.reposWithGeneration()
+	s.lock.RLock()
+	generatedAt := s.refreshedAt[s.reposPath]
+	s.lock.RUnlock()
+	setGenerationHeader(w, generation)
+	if r.URL.Query().Get("envelope") == "true" {
+		body = wrapInEnvelope(body, generatedAt)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
+
+// Serves the cached repos sorted by the view metric given in the sort query param, in the
+// order of the corresponding view, or a 404 when the views are disabled.
+func handleNetflixReposSorted(s *Server, w http.ResponseWriter, r *http.Request) {
+	sortBy := r.URL.Query().Get("sort")
+	s.lock.RLock()
+	var sorted []*viewElm
+	if sortBy == "forks" {
+		sorted = s.topForks
+	} else if sortBy == "last_updated" {
+		sorted = s.lastUpdated
+	} else if sortBy == "open_issues" {
+		sorted = s.topOpenIssues
+	} else if sortBy == "stars" {
+		sorted = s.topStars
+	} else {
+		s.lock.RUnlock()
+		s.writeError(w, fmt.Sprintf("Unknown sort %q, valid sorts are: forks, last_updated, "+
+			"open_issues, stars", sortBy), http.StatusBadRequest)
+		return
+	}
+	// The sorted views aren't built when the views are disabled.
+	if !s.config.EnableViews {
+		s.lock.RUnlock()
+		s.writeError(w, "Views are disabled", http.StatusNotFound)
+		return
+	}
+	if !s.config.viewMetricEnabled(sortBy) {
+		s.lock.RUnlock()
+		s.writeError(w, fmt.Sprintf("Sorting by %q is disabled", sortBy), http.StatusNotFound)
+		return
+	}
+	byID := make(map[int64]*github_types.Repository, len(s.repos))
+	for _, repo := range s.repos {
+		byID[*repo.ID] = repo
+	}
+	repos := make([]*github_types.Repository, 0, len(sorted))
+	for _, ve := range sorted {
+		repos = append(repos, byID[ve.id])
+	}
+	generatedAt := s.refreshedAt[s.reposPath]
+	setGenerationHeader(w, s.reposGeneration)
+	s.lock.RUnlock()
+	body, _ := json.Marshal(repos)
+	if r.URL.Query().Get("envelope") == "true" {
+		body = wrapInEnvelope(body, generatedAt)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
+
+// Serves the cached repos whose visibility matches private, filtered in memory.
+func handleNetflixReposByVisibility(s *Server, w http.ResponseWriter, r *http.Request,
+	private bool) {
+	for _, param := range []string{"names_only", "fields", "sort", "wrap"} {
+		if r.URL.Query().Has(param) {
+			s.writeError(w, fmt.Sprintf("visibility can't be combined with %v", param),
+				http.StatusBadRequest)
+			return
+		}
+	}
+	s.lock.RLock()
+	repos := make([]*github_types.Repository, 0, len(s.repos))
+	for _, repo := range s.repos {
+		// Github omits private for some tokens' repos, which are then public.
+		if (repo.Private != nil && *repo.Private) == private {
+			repos = append(repos, repo)
+		}
+	}
+	generatedAt := s.refreshedAt[s.reposPath]
+	setGenerationHeader(w, s.reposGeneration)
+	s.lock.RUnlock()
+	body, _ := json.Marshal(repos)
+	if r.URL.Query().Get("envelope") == "true" {
+		body = wrapInEnvelope(body, generatedAt)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
+
+// Response of github's search endpoints, for clients expecting that shape.
+type searchResponse struct {
+	TotalCount        int                        `json:"total_count"`
+	IncompleteResults bool                       `json:"incomplete_results"`
+	Items             []*github_types.Repository `json:"items"`
+}
+
+// Serves the cached repos wrapped like a github search response.
+func handleNetflixReposSearchWrapped(s *Server, w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	wrapped := searchResponse{TotalCount: len(s.repos), Items: s.repos}
+	if wrapped.Items == nil {
+		wrapped.Items = []*github_types.Repository{}
+	}
+	setGenerationHeader(w, s.reposGeneration)
+	// The repos are never modified once cached, only replaced, so marshal them unlocked.
+	s.lock.RUnlock()
+	body, err := json.Marshal(wrapped)
+	if err != nil {
+		s.writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
+
+// Serves the names of the cached repos as a JSON array of strings.
+func handleNetflixRepoNames(s *Server, w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	names := make([]string, 0, len(s.repos))
+	for _, repo := range s.repos {
+		names = append(names, *repo.Name)
+	}
+	generatedAt := s.refreshedAt[s.reposPath]
+	setGenerationHeader(w, s.reposGeneration)
+	s.lock.RUnlock()
+	body, _ := json.Marshal(names)
+	if r.URL.Query().Get("envelope") == "true" {
+		body = wrapInEnvelope(body, generatedAt)
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Write(body)
 }
 
 func handleNetflixMembers(s* Server, w http.ResponseWriter, r *http.Request) {
-	s.lock.Lock()
-	body := make([]byte, len(s.caches[kGitHubNetflixMembers]))
-	copy(body, s.caches[kGitHubNetflixMembers])
-	s.lock.Unlock()
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy != "" && sortBy != "login" {
+		s.writeError(w, fmt.Sprintf("Unknown sort %q, valid sorts are: login", sortBy),
+			http.StatusBadRequest)
+		return
+	}
+	role := r.URL.Query().Get("role")
+	if role != "" && role != "all" && role != "admin" && role != "member" {
+		s.writeError(w, fmt.Sprintf("Unknown role %q, valid roles are: all, admin, member", role),
+			http.StatusBadRequest)
+		return
+	}
+	if sortBy == "login" || role == "admin" || role == "member" {
+		handleNetflixMembersFiltered(s, w, r, role, sortBy == "login")
+		return
+	}
+	body := s.getCache(s.membersPath)
+	s.lock.RLock()
+	generatedAt := s.refreshedAt[s.membersPath]
+	s.lock.RUnlock()
+	if r.URL.Query().Get("envelope") == "true" {
+		body = wrapInEnvelope(body, generatedAt)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
+
+// Serves the cached members with the given role, all of them unless role is admin or
+// member, optionally sorted case insensitively by login.
+func handleNetflixMembersFiltered(s *Server, w http.ResponseWriter, r *http.Request,
+	role string, byLogin bool) {
+	s.lock.RLock()
+	if (role == "admin" || role == "member") && !s.memberRolesKnown {
+		s.lock.RUnlock()
+		s.writeError(w, "The roles of the members are unknown, the org owners couldn't be "+
+			"fetched", http.StatusServiceUnavailable)
+		return
+	}
+	members := make([]memberElm, 0, len(s.members))
+	for _, m := range s.members {
+		if (role == "admin" && !m.admin) || (role == "member" && m.admin) {
+			continue
+		}
+		members = append(members, m)
+	}
+	generatedAt := s.refreshedAt[s.membersPath]
+	s.lock.RUnlock()
+	if byLogin {
+		sort.SliceStable(members, func(i, j int) bool {
+			return strings.ToLower(members[i].login) < strings.ToLower(members[j].login)
+		})
+	}
+	raws := make([]json.RawMessage, len(members))
+	for ii, m := range members {
+		raws[ii] = m.raw
+	}
+	body, _ := json.Marshal(raws)
+	if r.URL.Query().Get("envelope") == "true" {
+		body = wrapInEnvelope(body, generatedAt)
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Write(body)
 }
 
+// Envelope wrapping a cached body along with the time the cache was last refreshed, served
+// when a client passes ?envelope=true.
+type cacheEnvelope struct {
+	GeneratedAt string          `json:"generated_at"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// Wraps a cached body in a cacheEnvelope.
+func wrapInEnvelope(body []byte, generatedAt time.Time) []byte {
+	// The cache is empty until its first refresh.
+	if len(body) == 0 {
+		body = []byte("null")
+	}
+	wrapped, err := json.Marshal(cacheEnvelope{
+		GeneratedAt: generatedAt.UTC().Format(time.RFC3339), Data: body})
+	if err != nil {
+		// The cached body wasn't valid JSON, serve it as is rather than hiding it.
+		return body
+	}
+	return wrapped
+}
+
+// Replies 404 to the views' paths when they are disabled with Config.EnableViews.
+func handleViewsDisabled(s *Server, w http.ResponseWriter, r *http.Request) {
+	s.writeJSONError(w, "Views are disabled", http.StatusNotFound)
+}
+
 func handleViews(s* Server, w http.ResponseWriter, r *http.Request) {
-	s.lock.Lock()
+	timeFormat := r.URL.Query().Get("time_format")
+	if timeFormat == "" {
+		timeFormat = kTimeFormatRFC3339
+	} else if timeFormat != kTimeFormatRFC3339 && timeFormat != kTimeFormatUnix &&
+		timeFormat != kTimeFormatUnixMs {
+		s.writeJSONError(w, fmt.Sprintf("Unknown time_format %q, valid formats are: %v, %v, %v",
+			timeFormat, kTimeFormatRFC3339, kTimeFormatUnix, kTimeFormatUnixMs),
+			http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != kFormatJSON && format != kFormatHTML {
+		s.writeJSONError(w, fmt.Sprintf("Unknown format %q, valid formats are: %v, %v",
+			format, kFormatJSON, kFormatHTML), http.StatusBadRequest)
+		return
+	}
+	// Repo names are qualified with the org, e.g. Netflix/zuul, unless ?qualified=false.
+	qualified := r.URL.Query().Get("qualified")
+	if qualified != "" && qualified != "true" && qualified != "false" {
+		s.writeJSONError(w, fmt.Sprintf("Invalid qualified %q, must be true or false", qualified),
+			http.StatusBadRequest)
+		return
+	}
+	prefix := s.org + "/"
+	if qualified == "false" {
+		prefix = ""
+	}
+	// Optional recency filter, ranking only the repos updated within the window.
+	var updatedSince time.Time
+	if window := r.URL.Query().Get("updated_within"); window != "" {
+		d, err := parseWindow(window)
+		if err != nil {
+			s.writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		updatedSince = time.Now().Add(-d)
+	}
+	// The change of each metric since the previous refresh follows the values with
+	// ?deltas=true.
+	deltas := r.URL.Query().Get("deltas")
+	if deltas != "" && deltas != "true" && deltas != "false" {
+		s.writeJSONError(w, fmt.Sprintf("Invalid deltas %q, must be true or false", deltas),
+			http.StatusBadRequest)
+		return
+	}
+	// The path is /view/top/N/<metrics>, or /view/top/<metrics> which omits N, which then
+	// defaults to Config.DefaultViewCount.
 	tokens := strings.Split(strings.TrimSpace(r.URL.Path), "/")
-	count, _ := strconv.Atoi(tokens[3])
-	sortBy := tokens[4]
-	body := "["
-	for ii := int(0); ii < count; ii++ {
-		var elm string
-		if sortBy == "forks" {
-			elm = fmt.Sprintf("[\"Netflix/%v\",%v]", s.topForks[ii].name, s.topForks[ii].forks)
-		} else if sortBy == "last_updated" {
-			elm = fmt.Sprintf("[\"Netflix/%v\",\"%vZ\"]", s.lastUpdated[ii].name, strings.TrimSuffix(s.lastUpdated[ii].updated.Local().String(), "-0700 PDT"))
-		} else if sortBy == "open_issues" {
-			elm = fmt.Sprintf("[\"Netflix/%v\",%v]", s.topOpenIssues[ii].name, s.topOpenIssues[ii].openIssues)
-		} else if sortBy == "stars" {
-			elm = fmt.Sprintf("[\"Netflix/%v\",%v]", s.topStars[ii].name, s.topStars[ii].stars)
-		}
-		body += elm
-		if ii < count - 1 {
-			body += ","
-		}
-	}
-	body += "]"
-	s.lock.Unlock()
-	w.Write([]byte(body))
+	if len(tokens) < 4 || len(tokens) > 5 || tokens[len(tokens)-1] == "" {
+		s.writeJSONError(w, fmt.Sprintf("Malformed view path %q, must be "+
+			"/view/top/[N/]<metric>[,<metric>...]", r.URL.Path), http.StatusBadRequest)
+		return
+	}
+	count := s.config.DefaultViewCount
+	metricsToken := tokens[3]
+	if len(tokens) == 5 {
+		var err error
+		if count, err = strconv.Atoi(tokens[3]); err != nil {
+			s.writeJSONError(w, fmt.Sprintf("Invalid N %q, must be an integer", tokens[3]),
+				http.StatusBadRequest)
+			return
+		}
+		metricsToken = tokens[4]
+	}
+	// A negative N asks for no results, like N=0.
+	if count < 0 {
+		count = 0
+	}
+	// Comma separated metrics to sort by, the first one being the primary one.
+	metrics := strings.Split(metricsToken, ",")
+	for _, metric := range metrics {
+		if !IsViewMetric(metric) {
+			s.writeJSONError(w, fmt.Sprintf("Unknown metric %q, valid metrics are: %v", metric,
+				strings.Join(kViewMetrics, ", ")), http.StatusBadRequest)
+			return
+		}
+		if !s.config.viewMetricEnabled(metric) {
+			s.writeJSONError(w, fmt.Sprintf("Views of metric %q are disabled", metric),
+				http.StatusNotFound)
+			return
+		}
+	}
+	sortBy := metrics[0]
+	s.lock.RLock()
+	// The views only change when the repos are refreshed, so the refresh generation
+	// identifies their content, along with the nonce of this process since the generations
+	// restart on every restart and differ between instances. Except with ?updated_within,
+	// whose window slides with time, so repos age out of it between refreshes.
+	setGenerationHeader(w, s.reposGeneration)
+	if updatedSince.IsZero() {
+		etag := fmt.Sprintf("W/\"%s-%d\"", s.etagNonce, s.reposGeneration)
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			s.lock.RUnlock()
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	// N=0 is a valid request for an empty view. It always gets an empty array with a 200,
+	// independently of any filters and of EmptyViewStatus, since no results were asked for.
+	if count == 0 {
+		s.lock.RUnlock()
+		if format == kFormatHTML {
+			writeHTMLView(w, s.org, metricsToken, nil)
+		} else {
+			w.Write([]byte("[]"))
+		}
+		return
+	}
+	// Optional license filter, matched case insensitively against the SPDX ID.
+	license := r.URL.Query().Get("license")
+	// The default branch of each repo ends its row with ?default_branch=true.
+	defaultBranch := r.URL.Query().Get("default_branch")
+	if defaultBranch != "" && defaultBranch != "true" && defaultBranch != "false" {
+		s.lock.RUnlock()
+		s.writeJSONError(w, fmt.Sprintf("Invalid default_branch %q, must be true or false",
+			defaultBranch), http.StatusBadRequest)
+		return
+	}
+	// Refreshes replace the previous snapshot rather than modify it.
+	prevSnapshot := s.prevSnapshot
+	var sorted []*viewElm
+	if sortBy == "forks" {
+		sorted = s.topForks
+	} else if sortBy == "last_updated" {
+		sorted = s.lastUpdated
+	} else if sortBy == "open_issues" {
+		sorted = s.topOpenIssues
+	} else if sortBy == "stars" {
+		sorted = s.topStars
+	} else if sortBy == "contributors" {
+		sorted = s.topContributors
+	}
+	// Published slices are never modified, refreshes swap in new ones, so the view is
+	// rendered without the lock and never waits on a refresh.
+	s.lock.RUnlock()
+	// An N larger than the number of cached repos lists all of them.
+	if count > len(sorted) {
+		count = len(sorted)
+	}
+	if len(metrics) > 1 {
+		sorted = sortByMetrics(sorted, metrics)
+	}
+	// Walk the sorted slice, skipping filtered out elements, until we have count elements.
+	// Each element is a row of the JSON view, the qualified repo name followed by the values.
+	var elms [][]json.RawMessage
+	var rows []htmlViewRow
+	for _, ve := range sorted {
+		if len(elms) >= count {
+			break
+		}
+		if license != "" && !strings.EqualFold(ve.license, license) {
+			continue
+		}
+		if ve.updated.Before(updatedSince) {
+			continue
+		}
+		// The value of every sort metric as a JSON value.
+		values := make([]string, len(metrics))
+		for ii, metric := range metrics {
+			values[ii] = viewMetricValue(metric, ve, timeFormat)
+		}
+		if deltas == "true" {
+			var prev *viewElm
+			if p, ok := prevSnapshot[ve.name]; ok {
+				prev = &p
+			}
+			for _, metric := range metrics {
+				values = append(values, viewMetricDelta(metric, ve, prev))
+			}
+		}
+		// Marshal the name, which may hold characters that must be escaped in JSON.
+		name, _ := json.Marshal(prefix + ve.name)
+		row := []json.RawMessage{name}
+		for _, value := range values {
+			row = append(row, json.RawMessage(value))
+		}
+		if defaultBranch == "true" {
+			branch := []byte("null")
+			if ve.defaultBranch != "" {
+				branch, _ = json.Marshal(ve.defaultBranch)
+			}
+			row = append(row, branch)
+		}
+		elms = append(elms, row)
+		if format == kFormatHTML {
+			values = values[:len(metrics)]
+			for ii := range values {
+				values[ii] = strings.Trim(values[ii], "\"")
+			}
+			rows = append(rows, htmlViewRow{Rank: len(elms), Name: prefix + ve.name,
+				Link:  fmt.Sprintf("https://github.com/%s/%s", s.org, ve.name),
+				Value: strings.Join(values, ", ")})
+		}
+	}
+	if format == kFormatHTML {
+		writeHTMLView(w, s.org, metricsToken, rows)
+		return
+	}
+	if len(elms) == 0 {
+		if s.config.EmptyViewStatus == http.StatusNoContent {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.Write([]byte("[]"))
+		}
+		return
+	}
+	body, err := json.Marshal(elms)
+	if err != nil {
+		s.writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Declare the length, so that HEAD requests, whose body net/http discards, get the
+	// Content-Length a GET would.
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+// Parses the window of the views' updated_within query param, either a number of days such
+// as 30d or a go duration such as 12h.
+func parseWindow(window string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(window, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(window)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Invalid updated_within %q, must be a positive number of days "+
+			"such as 30d or a duration such as 12h", window)
+	}
+	return d, nil
+}
+
+// Formats a timestamp in a view as a JSON value according to the time_format query param:
+// an RFC3339 string in UTC, or a number of seconds or milliseconds since the Unix epoch.
+func formatViewTime(t time.Time, timeFormat string) string {
+	if timeFormat == kTimeFormatUnix {
+		return strconv.FormatInt(t.Unix(), 10)
+	} else if timeFormat == kTimeFormatUnixMs {
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	}
+	return strconv.Quote(t.UTC().Format(time.RFC3339))
+}
+
+// Returns whether an If-None-Match header value matches etag. Uses the weak comparison
+// mandated for If-None-Match, i.e. W/ prefixes are ignored.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,821 @@
+package server
+
+import (
+	"api-cache/http_utils"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Repos served by the fake github of the tests.
+const kTestRepos = `[
+{"id":1,"name":"a\"q","forks_count":3,"open_issues_count":1,"stargazers_count":10,
+ "updated_at":"2021-03-04T12:00:00Z",
+ "license":{"spdx_id":"Apache-2.0"},"default_branch":"main"},
+{"id":2,"name":"b","forks_count":5,"open_issues_count":0,"stargazers_count":20,
+ "updated_at":"2022-03-04T12:00:00Z","default_branch":"trunk"}]`
+
+// Latency under which a handler is deemed responsive, generous for slow CI machines.
+const kResponsiveLatency = time.Second
+
+// Transport sending every request to a fake github rather than to http_utils.BaseURL.
+type fakeGitHubTransport struct {
+	target *url.URL
+}
+
+func (t fakeGitHubTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// Starts a fake github serving handler, to which all requests to github are sent.
+func fakeGitHub(t *testing.T, handler http.Handler) {
+	upstream := httptest.NewServer(handler)
+	t.Cleanup(upstream.Close)
+	target, _ := url.Parse(upstream.URL)
+	http_utils.SetClient(&http.Client{Transport: fakeGitHubTransport{target}})
+}
+
+// Returns a handler serving the paths of org like github, with repos as its repos.
+func fakeOrg(org string, repos string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"current_user_url":"https://api.github.com/user"}`))
+	})
+	mux.HandleFunc("/orgs/"+org, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"login":"` + org + `"}`))
+	})
+	mux.HandleFunc("/orgs/"+org+"/repos", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(repos))
+	})
+	mux.HandleFunc("/orgs/"+org+"/members", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("role") == "admin" {
+			w.Write([]byte(`[{"login":"alice"}]`))
+			return
+		}
+		w.Write([]byte(`[{"login":"bob"},{"login":"alice"}]`))
+	})
+	return mux
+}
+
+// Creates a server of org with config, or the default config if nil, without running it.
+func newTestServer(t *testing.T, org string, config *Config) *Server {
+	return NewServer(0, "", org, config)
+}
+
+// Creates a server of DefaultOrg with config, whose caches are refreshed from a fake github
+// serving repos.
+func newRefreshedServerOf(t *testing.T, repos string, config *Config) *Server {
+	fakeGitHub(t, fakeOrg(DefaultOrg, repos))
+	s := newTestServer(t, DefaultOrg, config)
+	s.refreshCaches()
+	return s
+}
+
+// Serves a GET of path by s.
+func get(s *Server, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+// Returns the names of the repos served in body, as a JSON array.
+func repoNames(t *testing.T, body []byte) string {
+	t.Helper()
+	var repos []struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(body, &repos); err != nil {
+		t.Fatalf("Got %s, want repos, err=%v", body, err)
+	}
+	names := []string{}
+	for _, repo := range repos {
+		names = append(names, repo.Name)
+	}
+	got, _ := json.Marshal(names)
+	return string(got)
+}
+
+// Fails the test unless a GET of path by s is served within kResponsiveLatency.
+func assertResponsive(t *testing.T, s *Server, path string) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		get(s, path)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(kResponsiveLatency):
+		t.Fatalf("GET %v blocked for more than %v", path, kResponsiveLatency)
+	}
+}
+
+// Returns a fake github whose repos are, while blocking is set, only served once release
+// is closed, after signaling on fetching that a repos fetch is in progress.
+func blockingRepos(blocking *atomic.Bool, fetching chan struct{},
+	release chan struct{}) http.Handler {
+	org := fakeOrg(DefaultOrg, kTestRepos)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/orgs/Netflix/repos" && blocking.Load() {
+			select {
+			case fetching <- struct{}{}:
+			default:
+			}
+			<-release
+		}
+		org.ServeHTTP(w, r)
+	})
+}
+
+// The lock must never be held across network I/O, so that the handlers stay responsive
+// while a refresh waits on a slow github.
+func TestHandlersStayResponsiveDuringRefresh(t *testing.T) {
+	var blocking atomic.Bool
+	fetching, release := make(chan struct{}, 1), make(chan struct{})
+	fakeGitHub(t, blockingRepos(&blocking, fetching, release))
+	s := newTestServer(t, DefaultOrg, nil)
+	s.refreshCaches()
+	blocking.Store(true)
+	refreshed := make(chan struct{})
+	go func() {
+		s.refreshOnce(s.reposPath, s.refreshNetflixRepos)
+		close(refreshed)
+	}()
+	defer func() {
+		close(release)
+		<-refreshed
+	}()
+	<-fetching
+	for _, path := range []string{"/healthcheck", "/orgs/Netflix", "/orgs/Netflix/repos",
+		"/view/top/2/stars"} {
+		assertResponsive(t, s, path)
+	}
+}
+
+// The initial refresh doesn't block the handlers either.
+func TestHandlersStayResponsiveDuringInitialRefresh(t *testing.T) {
+	var blocking atomic.Bool
+	blocking.Store(true)
+	fetching, release := make(chan struct{}, 1), make(chan struct{})
+	fakeGitHub(t, blockingRepos(&blocking, fetching, release))
+	s := newTestServer(t, DefaultOrg, nil)
+	refreshed := make(chan struct{})
+	go func() {
+		s.refreshOnce(s.reposPath, s.refreshNetflixRepos)
+		close(refreshed)
+	}()
+	<-fetching
+	assertResponsive(t, s, "/healthcheck")
+	assertResponsive(t, s, "/orgs/Netflix/repos")
+	close(release)
+	<-refreshed
+	if body := get(s, "/orgs/Netflix/repos").Body.String(); !strings.Contains(body, `"b"`) {
+		t.Errorf("Repos not cached after the refresh, got %v", body)
+	}
+}
+
+// The config is logged as attributes, without the api token.
+func TestLogConfig(t *testing.T) {
+	s := NewServer(0, "hunter2", DefaultOrg, nil)
+	var b bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&b, nil)))
+	s.logConfig()
+	var attrs map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &attrs); err != nil {
+		t.Fatalf("Got %v, want a JSON record, err=%v", b.String(), err)
+	}
+	if attrs["org"] != "Netflix" || attrs["tokens"] != 1.0 ||
+		strings.Contains(b.String(), "hunter2") {
+		t.Errorf("Got %v, want the org and no api token", b.String())
+	}
+}
+
+// The watchdog flags caches whose refreshes stopped completing, not those whose refreshes
+// complete but fail.
+func TestWatchdogIgnoresFailedRefreshes(t *testing.T) {
+	fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	config := DefaultConfig()
+	config.GitHubMaxAttempts = 1
+	config.ValidateJSON = true
+	s := newTestServer(t, DefaultOrg, config)
+	startedAt := time.Now().Add(-time.Hour)
+	s.refreshCaches()
+	s.checkRefreshStall(startedAt, time.Now())
+	if s.stalled {
+		t.Errorf("Stalled after failed refreshes completed")
+	}
+	s.checkRefreshStall(startedAt, time.Now().Add(time.Hour))
+	if !s.stalled {
+		t.Errorf("Not stalled after no refresh completed for an hour")
+	}
+}
+
+// A page that isn't a list rejects the whole list rather than silently dropping its items.
+func TestRefreshRejectsUndecodablePage(t *testing.T) {
+	var broken atomic.Bool
+	org := fakeOrg(DefaultOrg, kTestRepos)
+	fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/orgs/Netflix/repos" && broken.Load() {
+			w.Write([]byte(`{"message":"not a list"}`))
+			return
+		}
+		org.ServeHTTP(w, r)
+	}))
+	s := newTestServer(t, DefaultOrg, nil)
+	s.refreshCaches()
+	broken.Store(true)
+	s.refreshNetflixRepos(context.Background())
+	if body := get(s, "/orgs/Netflix/repos").Body.String(); !strings.Contains(body, `"b"`) {
+		t.Errorf("Got %v, want the stale repos", body)
+	}
+}
+
+// Pages wrapping their items in an object, like github's search endpoints, are flattened
+// like bare arrays.
+func TestRefreshWrappedItems(t *testing.T) {
+	fakeGitHub(t, fakeOrg(DefaultOrg, `{"total_count":2,"items":`+kTestRepos+`}`))
+	s := newTestServer(t, DefaultOrg, nil)
+	s.refreshCaches()
+	if w := get(s, "/view/top/2/stars"); !strings.Contains(w.Body.String(), `"Netflix/a\"q",10`) {
+		t.Errorf("Got %v, want both repos", w.Body.String())
+	}
+}
+
+// A refresh dropping more than MaxRepoDropPercent of the repos is rejected and logged,
+// keeping the previous cache, while a smaller drop is accepted.
+func TestRepoDropRejected(t *testing.T) {
+	var repos atomic.Value
+	repos.Store(kTestRepos)
+	fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fakeOrg(DefaultOrg, repos.Load().(string)).ServeHTTP(w, r)
+	}))
+	config := DefaultConfig()
+	config.MaxRepoDropPercent = 50
+	s := newTestServer(t, DefaultOrg, config)
+	s.refreshCaches()
+	want := get(s, "/orgs/Netflix/repos").Body.String()
+	var b bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&b, nil)))
+	repos.Store(`[]`)
+	s.refreshCaches()
+	if got := get(s, "/orgs/Netflix/repos").Body.String(); got != want {
+		t.Errorf("Got %v after dropping all repos, want the previous %v", got, want)
+	}
+	if !strings.Contains(b.String(), "Rejecting refresh of /orgs/Netflix/repos") {
+		t.Errorf("Got log %q, want the rejection logged", b.String())
+	}
+	repos.Store(kTestRepos[:strings.Index(kTestRepos, ",\n{")] + "]")
+	s.refreshCaches()
+	if got := get(s, "/orgs/Netflix/repos").Body.String(); strings.Contains(got, `"b"`) {
+		t.Errorf("Got %v after dropping half the repos, want the drop accepted", got)
+	}
+}
+
+// Github is only reachable if the latest refreshes of all the paths reached it, and bodies
+// rejected after being fetched don't make it unreachable.
+func TestHealthGitHubReachable(t *testing.T) {
+	var failRoot, invalidRepos atomic.Bool
+	org := fakeOrg(DefaultOrg, kTestRepos)
+	fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" && failRoot.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Path == "/orgs/Netflix/repos" && invalidRepos.Load() {
+			w.Write([]byte(`[{"id":`))
+			return
+		}
+		org.ServeHTTP(w, r)
+	}))
+	config := DefaultConfig()
+	config.GitHubMaxAttempts = 1
+	config.ValidateJSON = true
+	s := newTestServer(t, DefaultOrg, config)
+	health := func() healthSummary {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/healthcheck", nil)
+		r.Header.Set("Accept", "application/json")
+		s.ServeHTTP(w, r)
+		var summary healthSummary
+		if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+			t.Fatalf("Got %v %v, want a JSON summary", w.Code, w.Body)
+		}
+		return summary
+	}
+	for _, test := range []struct {
+		name                   string
+		failRoot, invalidRepos bool
+		status                 string
+		reachable              bool
+	}{
+		{"all refreshed", false, false, kHealthOK, true},
+		{"root failing", true, false, kHealthDegraded, false},
+		{"repos rejected", false, true, kHealthOK, true},
+	} {
+		failRoot.Store(test.failRoot)
+		invalidRepos.Store(test.invalidRepos)
+		refreshedAt := time.Now().Truncate(time.Second)
+		s.refreshCaches()
+		summary := health()
+		if summary.Status != test.status || summary.GitHubReachable != test.reachable {
+			t.Errorf("%v: got %+v, want status %v and github_reachable=%v", test.name,
+				summary, test.status, test.reachable)
+		}
+		lastSuccess, err := time.Parse(time.RFC3339, summary.GitHubLastSuccess)
+		if err != nil || lastSuccess.Before(refreshedAt) {
+			t.Errorf("%v: got github_last_success %v, want at least %v", test.name,
+				summary.GitHubLastSuccess, refreshedAt.Format(time.RFC3339))
+		}
+	}
+}
+
+// Null entries in the repos pages are skipped rather than crashing the refresh.
+func TestRefreshSkipsNullRepos(t *testing.T) {
+	fakeGitHub(t, fakeOrg(DefaultOrg, "[null,"+strings.TrimPrefix(kTestRepos, "[")))
+	s := newTestServer(t, DefaultOrg, nil)
+	s.refreshCaches()
+	want := `[["Netflix/b",20],["Netflix/a\"q",10]]`
+	if w := get(s, "/view/top/10/stars"); w.Body.String() != want {
+		t.Errorf("Got view %v, want %v", w.Body.String(), want)
+	}
+	if body := get(s, "/orgs/Netflix/repos").Body.String(); strings.HasPrefix(body, "[null") ||
+		!strings.Contains(body, `"b"`) {
+		t.Errorf("Got repos %v, want both repos without the null", body)
+	}
+}
+
+// The routes and the view prefixes follow the org passed to NewServer.
+func TestNonDefaultOrg(t *testing.T) {
+	fakeGitHub(t, fakeOrg("acme", kTestRepos))
+	s := newTestServer(t, "acme", nil)
+	s.refreshCaches()
+	for _, path := range []string{"/orgs/acme", "/orgs/acme/repos", "/orgs/acme/members"} {
+		if _, pattern := s.mux.Handler(httptest.NewRequest("GET", path, nil)); pattern != path {
+			t.Errorf("Got route %q for %v, want its own", pattern, path)
+		}
+	}
+	_, pattern := s.mux.Handler(httptest.NewRequest("GET", "/orgs/Netflix/repos", nil))
+	if pattern != kGitHubRoot {
+		t.Errorf("Got route %q for Netflix's repos, want them proxied for another org", pattern)
+	}
+	if body := get(s, "/orgs/acme").Body.String(); body != `{"login":"acme"}` {
+		t.Errorf("Got org %v, want acme's", body)
+	}
+	if body := get(s, "/orgs/acme/members").Body.String(); !strings.Contains(body, `"bob"`) {
+		t.Errorf("Got members %v, want acme's", body)
+	}
+	want := `[["acme/b",20],["acme/a\"q",10]]`
+	if body := get(s, "/view/top/2/stars").Body.String(); body != want {
+		t.Errorf("Got view %v, want %v", body, want)
+	}
+	if body := get(s, "/feed/updated").Body.String(); !strings.Contains(body,
+		"https://github.com/acme/b") {
+		t.Errorf("Got feed %v, want links to acme's repos", body)
+	}
+}
+
+// Readers share the lock with each other and with the refreshes. Run with -race.
+func TestConcurrentReadersDuringRefresh(t *testing.T) {
+	fakeGitHub(t, fakeOrg(DefaultOrg, kTestRepos))
+	config := DefaultConfig()
+	config.AdminSecret = kTestAdminSecret
+	s := newTestServer(t, DefaultOrg, config)
+	s.refreshCaches()
+	done := make(chan struct{})
+	refreshed := make(chan struct{})
+	go func() {
+		defer close(refreshed)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				s.refreshCaches()
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for reader := 0; reader < 20; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, path := range []string{"/", "/orgs/Netflix", "/orgs/Netflix/repos",
+				"/orgs/Netflix/members", "/view/top/2/stars", "/view/top/2/last_updated",
+				"/healthcheck", "/metrics", "/feed/updated", "/admin/diff"} {
+				// The routes other than /admin/diff ignore the admin secret.
+				if w := getAdmin(s, path); w.Code != http.StatusOK {
+					t.Errorf("Got %v for %v during a refresh", w.Code, path)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-refreshed
+}
+
+// A failing github keeps the previous caches served rather than crashing or emptying them.
+func TestFailingGitHubServesStaleCaches(t *testing.T) {
+	var failing atomic.Bool
+	org := fakeOrg(DefaultOrg, kTestRepos)
+	fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !failing.Load() {
+			org.ServeHTTP(w, r)
+			return
+		}
+		// Drop the connection without a response.
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	config := DefaultConfig()
+	config.GitHubMaxAttempts = 1
+	s := newTestServer(t, DefaultOrg, config)
+	s.refreshCaches()
+	want := map[string]string{}
+	paths := []string{"/", "/orgs/Netflix", "/orgs/Netflix/repos", "/orgs/Netflix/members",
+		"/view/top/2/stars"}
+	for _, path := range paths {
+		want[path] = get(s, path).Body.String()
+	}
+	failing.Store(true)
+	s.refreshCaches()
+	s.lock.RLock()
+	reachable := s.githubReachable
+	s.lock.RUnlock()
+	if reachable {
+		t.Errorf("Github deemed reachable after failed refreshes")
+	}
+	for _, path := range paths {
+		if w := get(s, path); w.Code != http.StatusOK || w.Body.String() != want[path] {
+			t.Errorf("Got %v %v for %v, want the stale %v", w.Code, w.Body.String(), path,
+				want[path])
+		}
+	}
+	if w := get(s, "/repos/Netflix/b"); w.Code != http.StatusBadGateway {
+		t.Errorf("Got %v proxying to a failing github, want 502", w.Code)
+	}
+}
+
+// The proxy's errors follow the Config.StructuredErrors of the latest server, rather than
+// of whichever server enabled them first.
+func TestProxyErrorFormat(t *testing.T) {
+	fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	for _, structured := range []bool{true, false} {
+		config := DefaultConfig()
+		config.GitHubMaxAttempts = 1
+		config.StructuredErrors = structured
+		s := newTestServer(t, DefaultOrg, config)
+		w := get(s, "/repos/Netflix/b")
+		if isJSON := strings.HasPrefix(w.Body.String(), `{"error":{`); w.Code !=
+			http.StatusBadGateway || isJSON != structured {
+			t.Errorf("Got %v %v with StructuredErrors=%v", w.Code, w.Body.String(), structured)
+		}
+	}
+}
+
+// Requests past MaxConcurrentRequests are shed with a 503 and a Retry-After, except for the
+// liveness probe.
+func TestMaxConcurrentRequests(t *testing.T) {
+	fetching, release := make(chan struct{}), make(chan struct{})
+	org := fakeOrg(DefaultOrg, kTestRepos)
+	fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/Netflix/b" {
+			fetching <- struct{}{}
+			<-release
+		}
+		org.ServeHTTP(w, r)
+	}))
+	config := DefaultConfig()
+	config.MaxConcurrentRequests = 1
+	s := newTestServer(t, DefaultOrg, config)
+	s.refreshCaches()
+	done := make(chan struct{})
+	go func() {
+		get(s, "/repos/Netflix/b")
+		close(done)
+	}()
+	<-fetching
+	w := get(s, "/orgs/Netflix/repos")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Got %v with Retry-After %q past the cap, want 503 with a Retry-After",
+			w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := get(s, "/livez"); w.Code != http.StatusOK {
+		t.Errorf("Got %v for /livez past the cap, want 200", w.Code)
+	}
+	close(release)
+	<-done
+	if w := get(s, "/orgs/Netflix/repos"); w.Code != http.StatusOK {
+		t.Errorf("Got %v once the in-flight request completed, want 200", w.Code)
+	}
+}
+
+// With ExcludeArchived, archived and disabled repos are left out of the repos cache and the
+// views, and they are kept otherwise.
+func TestExcludeArchived(t *testing.T) {
+	const repos = `[
+{"id":1,"name":"archived","forks_count":0,"open_issues_count":0,"stargazers_count":30,
+ "updated_at":"2022-03-04T12:00:00Z","archived":true},
+{"id":2,"name":"disabled","forks_count":0,"open_issues_count":0,"stargazers_count":20,
+ "updated_at":"2022-03-04T12:00:00Z","disabled":true},
+{"id":3,"name":"live","forks_count":0,"open_issues_count":0,"stargazers_count":10,
+ "updated_at":"2022-03-04T12:00:00Z","archived":false}]`
+	for _, test := range []struct {
+		exclude bool
+		repos   string
+		view    string
+	}{
+		{true, `["live"]`, `[["Netflix/live",10]]`},
+		{false, `["archived","disabled","live"]`,
+			`[["Netflix/archived",30],["Netflix/disabled",20],["Netflix/live",10]]`},
+	} {
+		config := DefaultConfig()
+		config.ExcludeArchived = test.exclude
+		s := newRefreshedServerOf(t, repos, config)
+		if got := repoNames(t, get(s, "/orgs/Netflix/repos").Body.Bytes()); got != test.repos {
+			t.Errorf("Got repos %s with ExcludeArchived=%v, want %v", got, test.exclude,
+				test.repos)
+		}
+		if got := get(s, "/view/top/3/stars").Body.String(); got != test.view {
+			t.Errorf("Got view %v with ExcludeArchived=%v, want %v", got, test.exclude,
+				test.view)
+		}
+	}
+}
+
+// With envelope=true, the repos and members are wrapped along with the time of their last
+// refresh, with null data until then.
+func TestEnvelope(t *testing.T) {
+	fakeGitHub(t, fakeOrg(DefaultOrg, kTestRepos))
+	s := newTestServer(t, DefaultOrg, nil)
+	var envelope struct {
+		GeneratedAt string          `json:"generated_at"`
+		Data        json.RawMessage `json:"data"`
+	}
+	for _, path := range []string{"/orgs/Netflix/repos", "/orgs/Netflix/members"} {
+		body := get(s, path+"?envelope=true").Body.Bytes()
+		if err := json.Unmarshal(body, &envelope); err != nil || string(envelope.Data) != "null" {
+			t.Errorf("Got %s for %v before the first refresh, want null data", body, path)
+		}
+	}
+	start := time.Now().Truncate(time.Second)
+	s.refreshCaches()
+	for _, path := range []string{"/orgs/Netflix/repos", "/orgs/Netflix/members"} {
+		body := get(s, path+"?envelope=true").Body.Bytes()
+		var data []json.RawMessage
+		if err := json.Unmarshal(body, &envelope); err != nil {
+			t.Errorf("Got %s for %v, want an envelope", body, path)
+			continue
+		}
+		generatedAt, err := time.Parse(time.RFC3339, envelope.GeneratedAt)
+		if err != nil || generatedAt.Before(start) {
+			t.Errorf("Got generated_at %v for %v, want the refresh time", envelope.GeneratedAt,
+				path)
+		}
+		if err := json.Unmarshal(envelope.Data, &data); err != nil || len(data) != 2 {
+			t.Errorf("Got data %s for %v, want the 2 cached items", envelope.Data, path)
+		}
+		if raw := get(s, path).Body.String(); !strings.HasPrefix(raw, "[") {
+			t.Errorf("Got %v for %v without envelope, want the raw array", raw, path)
+		}
+	}
+}
+
+// With names_only=true, only the names of the cached repos are served, as JSON.
+func TestReposNamesOnly(t *testing.T) {
+	fakeGitHub(t, fakeOrg(DefaultOrg, kTestRepos))
+	s := newTestServer(t, DefaultOrg, nil)
+	s.refreshCaches()
+	w := get(s, "/orgs/Netflix/repos?names_only=true")
+	if want := `["a\"q","b"]`; w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("Got %v %v, want 200 %v", w.Code, w.Body.String(), want)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Got Content-Type %v, want JSON", ct)
+	}
+}
+
+// Bodies above MaxRequestBodyBytes are refused with a 413 without reaching github, and
+// bodies within the limit are proxied whole.
+func TestMaxRequestBodyBytes(t *testing.T) {
+	var received atomic.Int64
+	fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received.Store(int64(len(body)))
+		w.Write([]byte(`{}`))
+	}))
+	config := DefaultConfig()
+	config.MaxRequestBodyBytes = 16
+	s := newTestServer(t, DefaultOrg, config)
+	for _, test := range []struct {
+		size     int
+		status   int
+		received int64
+	}{
+		{17, http.StatusRequestEntityTooLarge, -1},
+		{16, http.StatusOK, 16},
+	} {
+		received.Store(-1)
+		r := httptest.NewRequest("POST", "/repos/Netflix/b/issues",
+			strings.NewReader(strings.Repeat("x", test.size)))
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != test.status || received.Load() != test.received {
+			t.Errorf("Got %v with github receiving %v bytes for a %v bytes body, want %v "+
+				"and %v", w.Code, received.Load(), test.size, test.status, test.received)
+		}
+	}
+}
+
+// With ProxyForceJSON, proxied requests ask github for JSON whatever the client accepts,
+// and the client's Accept is passed through otherwise.
+func TestProxyForceJSON(t *testing.T) {
+	var accept atomic.Value
+	fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept.Store(r.Header.Get("Accept"))
+		w.Write([]byte(`{}`))
+	}))
+	for _, test := range []struct {
+		force bool
+		want  string
+	}{
+		{true, "application/vnd.github+json"},
+		{false, "application/vnd.github.raw"},
+	} {
+		config := DefaultConfig()
+		config.ProxyForceJSON = test.force
+		s := newTestServer(t, DefaultOrg, config)
+		r := httptest.NewRequest("GET", "/repos/Netflix/b/readme", nil)
+		r.Header.Set("Accept", "application/vnd.github.raw")
+		s.ServeHTTP(httptest.NewRecorder(), r)
+		if got := accept.Load(); got != test.want {
+			t.Errorf("Github got Accept %v with ProxyForceJSON=%v, want %v", got, test.force,
+				test.want)
+		}
+	}
+}
+
+// Serves a GET of path by s, authenticated with the admin secret.
+func getAdmin(s *Server, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("Authorization", "Bearer "+kTestAdminSecret)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// All the admin endpoints require the admin secret, and are refused if none is configured.
+func TestAdminEndpointsNeedAdminSecret(t *testing.T) {
+	fakeGitHub(t, fakeOrg(DefaultOrg, kTestRepos))
+	config := DefaultConfig()
+	config.AdminSecret = kTestAdminSecret
+	s := newTestServer(t, DefaultOrg, config)
+	s.refreshCaches()
+	unconfigured := newTestServer(t, DefaultOrg, nil)
+	for _, path := range []string{kAdminDiff, kAdminStats, kAdminMaintenance, kAdminLogLevel,
+		kAdminPagination, kAdminErrors} {
+		if w := get(s, path); w.Code != http.StatusUnauthorized {
+			t.Errorf("Got %v for %v without the admin secret, want 401", w.Code, path)
+		}
+		if w := getAdmin(s, path); w.Code != http.StatusOK {
+			t.Errorf("Got %v %v for %v with the admin secret, want 200", w.Code,
+				w.Body.String(), path)
+		}
+		if w := getAdmin(unconfigured, path); w.Code != http.StatusForbidden {
+			t.Errorf("Got %v for %v without a configured admin secret, want 403", w.Code, path)
+		}
+	}
+}
+
+// With sort=<metric>, the cached repos are served in the order of the metric's view, and
+// unknown metrics get a 400.
+func TestReposSorted(t *testing.T) {
+	s := newRefreshedServer(t, nil)
+	for _, test := range []struct {
+		sort  string
+		names string
+	}{
+		{"stars", `["b","a\"q"]`},
+		{"open_issues", `["a\"q","b"]`},
+	} {
+		w := get(s, "/orgs/Netflix/repos?sort="+test.sort)
+		if got := repoNames(t, w.Body.Bytes()); w.Code != http.StatusOK || got != test.names {
+			t.Errorf("Got %v %s for sort=%v, want 200 %v", w.Code, got, test.sort, test.names)
+		}
+	}
+	if w := get(s, "/orgs/Netflix/repos?sort=size"); w.Code != http.StatusBadRequest {
+		t.Errorf("Got %v for an unknown sort, want 400", w.Code)
+	}
+}
+
+// With the views disabled, sort=<metric> gets a 404 rather than an empty list.
+func TestReposSortedViewsDisabled(t *testing.T) {
+	config := DefaultConfig()
+	config.EnableViews = false
+	s := newRefreshedServer(t, config)
+	w := get(s, "/orgs/Netflix/repos?sort=stars")
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "Views are disabled") {
+		t.Errorf("Got %v %v, want 404", w.Code, w.Body.String())
+	}
+}
+
+// With wrap=search, the repos are wrapped like a github search response.
+func TestReposSearchWrapped(t *testing.T) {
+	fakeGitHub(t, fakeOrg(DefaultOrg, kTestRepos))
+	s := newTestServer(t, DefaultOrg, nil)
+	s.refreshCaches()
+	var wrapped struct {
+		TotalCount        int               `json:"total_count"`
+		IncompleteResults *bool             `json:"incomplete_results"`
+		Items             []json.RawMessage `json:"items"`
+	}
+	w := get(s, "/orgs/Netflix/repos?wrap=search")
+	if err := json.Unmarshal(w.Body.Bytes(), &wrapped); err != nil ||
+		wrapped.TotalCount != 2 || len(wrapped.Items) != 2 ||
+		wrapped.IncompleteResults == nil || *wrapped.IncompleteResults {
+		t.Errorf("Got %v %v, want the 2 repos wrapped", w.Code, w.Body.String())
+	}
+	if w := get(s, "/orgs/Netflix/repos?wrap=list"); w.Code != http.StatusBadRequest {
+		t.Errorf("Got %v for an unknown wrap, want 400", w.Code)
+	}
+}
+
+// The repos checksum is the SHA-256 of the served repos, and changes with them.
+func TestReposChecksum(t *testing.T) {
+	fakeGitHub(t, fakeOrg(DefaultOrg, kTestRepos))
+	s := newTestServer(t, DefaultOrg, nil)
+	if w := get(s, "/orgs/Netflix/repos/checksum"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got %v before the first refresh, want 503", w.Code)
+	}
+	var prev string
+	for _, repos := range []string{kTestRepos, strings.Replace(kTestRepos,
+		`"stargazers_count":20`, `"stargazers_count":25`, 1)} {
+		fakeGitHub(t, fakeOrg(DefaultOrg, repos))
+		s.refreshCaches()
+		var checksum struct {
+			SHA256 string `json:"sha256"`
+		}
+		json.Unmarshal(get(s, "/orgs/Netflix/repos/checksum").Body.Bytes(), &checksum)
+		sum := sha256.Sum256(get(s, "/orgs/Netflix/repos").Body.Bytes())
+		if want := hex.EncodeToString(sum[:]); checksum.SHA256 != want {
+			t.Errorf("Got checksum %v, want %v", checksum.SHA256, want)
+		}
+		if checksum.SHA256 == prev {
+			t.Errorf("Got the same checksum %v after the repos changed", prev)
+		}
+		prev = checksum.SHA256
+	}
+}
+
+// With visibility=public|private, only the matching repos are served, repos without
+// private being public, and other visibilities get a 400.
+func TestReposVisibility(t *testing.T) {
+	s := newRefreshedServerOf(t, `[
+{"id":1,"name":"secret","forks_count":0,"open_issues_count":0,"stargazers_count":1,
+ "updated_at":"2022-03-04T12:00:00Z","private":true},
+{"id":2,"name":"open","forks_count":0,"open_issues_count":0,"stargazers_count":1,
+ "updated_at":"2022-03-04T12:00:00Z","private":false},
+{"id":3,"name":"unset","forks_count":0,"open_issues_count":0,"stargazers_count":1,
+ "updated_at":"2022-03-04T12:00:00Z"}]`, nil)
+	for _, test := range []struct {
+		visibility string
+		names      string
+	}{
+		{"public", `["open","unset"]`},
+		{"private", `["secret"]`},
+		{"all", `["secret","open","unset"]`},
+	} {
+		w := get(s, "/orgs/Netflix/repos?visibility="+test.visibility)
+		if got := repoNames(t, w.Body.Bytes()); w.Code != http.StatusOK || got != test.names {
+			t.Errorf("Got %v %s for visibility=%v, want 200 %v", w.Code, got, test.visibility,
+				test.names)
+		}
+	}
+	for _, path := range []string{"/orgs/Netflix/repos?visibility=internal",
+		"/orgs/Netflix/repos?visibility=public&sort=stars"} {
+		if w := get(s, path); w.Code != http.StatusBadRequest {
+			t.Errorf("Got %v for %v, want 400", w.Code, path)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"api-cache/github_types"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+)
+
+// This file contains snapshot mode, in which the repos cache and the views are built once
+// at startup from a file holding a JSON array of repos (e.g. a saved /export/repos.json),
+// and github is never accessed: there is no refresh loop and nothing is proxied. This is
+// meant for offline demos and reproducible testing.
+
+// Returns whether the server serves a snapshot rather than data fetched from github.
+func (s *Server) offline() bool {
+	return s.config.SnapshotFile != ""
+}
+
+// Loads the repos snapshot file into the repos cache and the views.
+func (s *Server) loadSnapshot() {
+	path := s.config.SnapshotFile
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Panicf("Failed to read snapshot file %v, err=%v", path, err.Error())
+	}
+	var repos []*github_types.Repository
+	if err := json.Unmarshal(body, &repos); err != nil {
+		log.Panicf("Snapshot file %v isn't a JSON array of repos, err=%v", path, err.Error())
+	}
+	s.ingestRepos(context.Background(), repos, "")
+	log.Printf("Loaded %v repos from snapshot file %v", len(repos), path)
+}
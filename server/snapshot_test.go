@@ -0,0 +1,33 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Snapshot entries lacking the fields the views need are skipped rather than crashing the
+// server at startup.
+func TestSnapshotSkipsIncompleteRepos(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "repos.json")
+	if err := os.WriteFile(path, []byte(`[
+{"id":1,"name":"no_counts"},
+{"name":"no_id","forks_count":1,"open_issues_count":1,"stargazers_count":30,
+ "updated_at":"2022-03-04T12:00:00Z"},
+{"id":3,"name":"no_updated_at","forks_count":1,"open_issues_count":1,"stargazers_count":20},
+`+strings.TrimPrefix(kTestRepos, "[")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.SnapshotFile = path
+	s := newTestServer(t, DefaultOrg, config)
+	s.loadSnapshot()
+	want := `[["Netflix/b",20],["Netflix/a\"q",10]]`
+	if w := get(s, "/view/top/10/stars"); w.Body.String() != want {
+		t.Errorf("Got view %v, want %v", w.Body.String(), want)
+	}
+	if w := get(s, "/orgs/Netflix/repos?names_only=true"); w.Body.String() != `["a\"q","b"]` {
+		t.Errorf("Got repos %v, want only the complete ones", w.Body.String())
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file contains the freshness headers of cached responses. Every response served
+// from a cache carries its age in seconds in X-Data-Age, and once the cache has outlived
+// its refresh interval because refreshes failed, also the RFC 7234 staleness warning
+// Warning: 110 - "Response is Stale".
+
+// Returns the cached path whose data the response to path is served from, or the empty
+// string if it isn't served from a cache.
+func (s *Server) cachedPathFor(path string) string {
+	// All the views are built from the repos, and aren't served when disabled.
+	if strings.HasPrefix(path, kViewsRoot) {
+		if !s.config.EnableViews {
+			return ""
+		}
+		return s.reposPath
+	}
+	if path == kExportRepos ||
+		path == s.reposPath+kChecksumSuffix {
+		return s.reposPath
+	}
+	if _, ok := s.refreshFns[path]; ok {
+		return path
+	}
+	return ""
+}
+
+// Sets the freshness headers of the response to path, if it is served from a cache.
+func (s *Server) setFreshnessHeaders(w http.ResponseWriter, path string, now time.Time) {
+	cached := s.cachedPathFor(path)
+	if cached == "" {
+		return
+	}
+	s.lock.RLock()
+	refreshedAt, populated := s.refreshedAt[cached]
+	attemptedAt, completedAt := s.attemptedAt[cached], s.completedAt[cached]
+	s.lock.RUnlock()
+	if !populated {
+		return
+	}
+	age := now.Sub(refreshedAt)
+	w.Header().Set("X-Data-Age", strconv.Itoa(int(age/time.Second)))
+	// The latest refresh started after the last successful one and completed, so it failed.
+	failed := attemptedAt.After(refreshedAt) && !completedAt.Before(attemptedAt)
+	if age > s.config.refreshIntervalFor(cached) && failed {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+}
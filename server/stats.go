@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// This file contains /admin/stats, which reports the server's internal state as JSON.
+
+type tokenStats struct {
+	Active   int `json:"active"`
+	Disabled int `json:"disabled"`
+}
+
+// Refresh timing of a cached path. Times are RFC3339, empty if there was none yet.
+type refreshStats struct {
+	LastCompleted string `json:"last_completed"`
+	LastSucceeded string `json:"last_succeeded"`
+	NextScheduled string `json:"next_scheduled"`
+}
+
+type serverStats struct {
+	Tokens  tokenStats              `json:"tokens"`
+	Refresh map[string]refreshStats `json:"refresh"`
+}
+
+// Formats t as RFC3339, or as the empty string if t is zero.
+func formatStatsTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func handleAdminStats(s *Server, w http.ResponseWriter, r *http.Request) {
+	var stats serverStats
+	stats.Tokens.Active, stats.Tokens.Disabled = s.tokens.Counts()
+	stats.Refresh = make(map[string]refreshStats)
+	s.lock.RLock()
+	for path := range s.refreshFns {
+		stats.Refresh[path] = refreshStats{
+			LastCompleted: formatStatsTime(s.completedAt[path]),
+			LastSucceeded: formatStatsTime(s.refreshedAt[path]),
+			NextScheduled: formatStatsTime(s.nextRefreshAt[path]),
+		}
+	}
+	s.lock.RUnlock()
+	body, err := json.Marshal(stats)
+	if err != nil {
+		s.writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// This file contains serving over TLS, optionally with mutual TLS. With mutual TLS, clients
+// must present a certificate signed by one of the configured CAs. The handshake only
+// verifies certificates that are presented (tls.VerifyClientCertIfGiven) rather than
+// requiring one (tls.RequireAndVerifyClientCert), because the liveness probe must keep
+// working for probes without a certificate. Every other route is then refused by the
+// handler wrapper unless the client presented a verified certificate.
+
+// Returns the TLS config of the server.
+func (s *Server) tlsConfig() *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.config.TLSClientCAFile == "" {
+		return config
+	}
+	pem, err := ioutil.ReadFile(s.config.TLSClientCAFile)
+	if err != nil {
+		log.Panicf("Failed to read client CA file %v, err=%v", s.config.TLSClientCAFile,
+			err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		log.Panicf("No certificates found in client CA file %v", s.config.TLSClientCAFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config
+}
+
+// Serve HTTPS on the configured port. This method doesn't return.
+func (s *Server) listenAndServeTLS() {
+	server := &http.Server{Addr: fmt.Sprintf(":%v", s.port), Handler: s,
+		TLSConfig: s.tlsConfig()}
+	err := server.ListenAndServeTLS(s.config.TLSCertFile, s.config.TLSKeyFile)
+	log.Panicf("Failed to serve TLS, err=%v", err)
+}
+
+// Refuses r with a 401 if mutual TLS is enabled and r's client didn't present a verified
+// certificate, and returns false in that case. Requests over the unix socket aren't
+// subject to mutual TLS.
+func (s *Server) checkClientCert(w http.ResponseWriter, r *http.Request) bool {
+	if s.config.TLSClientCAFile == "" || r.TLS == nil || r.URL.Path == kRouteLivez {
+		return true
+	}
+	if len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	s.writeError(w, "Client certificate required", http.StatusUnauthorized)
+	return false
+}
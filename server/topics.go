@@ -0,0 +1,48 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// This file contains /view/topics, which reports how many cached repos use each topic,
+// most used topics first.
+
+type topicCount struct {
+	Topic string `json:"topic"`
+	Count int    `json:"count"`
+}
+
+// Counts the repos using each topic, sorted by count and then by topic.
+func countTopics(elms []*viewElm) []topicCount {
+	counts := make(map[string]int)
+	for _, ve := range elms {
+		for _, t := range ve.topics {
+			counts[t]++
+		}
+	}
+	topics := make([]topicCount, 0, len(counts))
+	for t, c := range counts {
+		topics = append(topics, topicCount{Topic: t, Count: c})
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		if topics[i].Count != topics[j].Count {
+			return topics[i].Count > topics[j].Count
+		}
+		return topics[i].Topic < topics[j].Topic
+	})
+	return topics
+}
+
+func handleViewTopics(s *Server, w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	body, err := json.Marshal(s.topicCounts)
+	s.lock.RUnlock()
+	if err != nil {
+		s.writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
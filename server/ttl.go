@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// This file contains the coordination of cache refreshes between the background refresh
+// loops and on-access revalidation. A cache with a TTL configured in Config.CacheTTLs is
+// refreshed asynchronously when it is requested after its TTL expired, and the request is
+// served the stale cache meanwhile. A path is never refreshed twice concurrently.
+
+// Runs refresh for path unless a refresh of path is already running, in which case it
+// returns false right away.
+func (s *Server) refreshOnce(path string, refresh func(ctx context.Context)) bool {
+	s.lock.Lock()
+	if s.refreshing[path] {
+		s.lock.Unlock()
+		return false
+	}
+	s.refreshing[path] = true
+	s.attemptedAt[path] = time.Now()
+	s.lock.Unlock()
+
+	outcome := &fetchOutcome{}
+	refresh(context.WithValue(s.ctx, fetchOutcomeKey{}, outcome))
+
+	s.lock.Lock()
+	delete(s.refreshing, path)
+	s.completedAt[path] = time.Now()
+	// Followers refresh from the cache backend, which says nothing about github. Bodies
+	// rejected after being fetched don't make github unreachable.
+	if !s.config.Follower {
+		s.reachedGitHub[path] = !outcome.unreachable.Load()
+		if s.reachedGitHub[path] {
+			s.githubLastSuccess = s.completedAt[path]
+		}
+		s.githubReachable = true
+		for _, reached := range s.reachedGitHub {
+			s.githubReachable = s.githubReachable && reached
+		}
+	}
+	s.lock.Unlock()
+	return true
+}
+
+// Triggers an asynchronous refresh of path if it has a TTL and its cache is older than
+// that. Failed refreshes count as attempts, so that a failing path is retried at most once
+// per TTL rather than on every request.
+func (s *Server) revalidateIfExpired(path string) {
+	ttl, ok := s.config.CacheTTLs[path]
+	if !ok || s.offline() {
+		return
+	}
+	refresh, ok := s.refreshFns[path]
+	if !ok {
+		return
+	}
+	s.lock.RLock()
+	refreshedAt, populated := s.refreshedAt[path]
+	attemptedAt := s.attemptedAt[path]
+	s.lock.RUnlock()
+	// The initial refresh is still running.
+	if !populated {
+		return
+	}
+	if attemptedAt.After(refreshedAt) {
+		refreshedAt = attemptedAt
+	}
+	if time.Since(refreshedAt) <= ttl {
+		return
+	}
+	go s.refreshOnce(path, refresh)
+}
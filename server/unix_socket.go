@@ -0,0 +1,43 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Serve HTTP requests on the configured unix domain socket. A stale socket file left behind
+// by a previous process is removed first, and the socket file is removed again when the
+// process is interrupted or terminated.
+func (s *Server) listenUnix() {
+	path := s.config.UnixSocket
+	// Only remove a stale socket, never some other file that happens to be at the path.
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			log.Panicf("Refusing to replace non socket file %v with a unix socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			log.Panicf("Failed to remove stale unix socket %v, err=%v", path, err.Error())
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		log.Panicf("Failed to listen on unix socket %v, err=%v", path, err.Error())
+	}
+	// Closing the listener unlinks the socket file.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %v, removing unix socket %v", sig, path)
+		l.Close()
+		os.Exit(0)
+	}()
+	go func() {
+		http.Serve(l, s)
+	}()
+	log.Printf("Listening on unix socket %v", path)
+}
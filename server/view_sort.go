@@ -0,0 +1,96 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+// This file contains the multi-key sorting of the /view/top/N/<metric>[,<metric>...]
+// views. The first metric selects the precomputed sorted slice, which is then re-sorted on
+// demand by all the metrics in turn when there is more than one. With ?deltas=true, the
+// change of each metric since the previous refresh follows the values.
+
+// Metrics the views can be sorted by.
+var kViewMetrics = []string{"forks", "last_updated", "open_issues", "stars", "contributors"}
+
+// Returns whether metric is one the views can be sorted by.
+func IsViewMetric(metric string) bool {
+	for _, m := range kViewMetrics {
+		if m == metric {
+			return true
+		}
+	}
+	return false
+}
+
+// Compares view elements by metric. Returns a negative number if a ranks before b, i.e. a
+// has the larger or more recent value, a positive one if it ranks after and 0 if the
+// values are equal.
+func compareViewMetric(metric string, a *viewElm, b *viewElm) int {
+	var x, y int
+	if metric == "forks" {
+		x, y = a.forks, b.forks
+	} else if metric == "last_updated" {
+		if a.updated.After(b.updated) {
+			return -1
+		} else if a.updated.Before(b.updated) {
+			return 1
+		}
+		return 0
+	} else if metric == "open_issues" {
+		x, y = a.openIssues, b.openIssues
+	} else if metric == "stars" {
+		x, y = a.stars, b.stars
+	} else if metric == "contributors" {
+		x, y = a.contributors, b.contributors
+	}
+	return y - x
+}
+
+// Returns a copy of elms sorted by each of metrics in turn, then by tieBreakLess.
+func sortByMetrics(elms []*viewElm, metrics []string) []*viewElm {
+	sorted := make([]*viewElm, len(elms))
+	copy(sorted, elms)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		for _, metric := range metrics {
+			if c := compareViewMetric(metric, a, b); c != 0 {
+				return c < 0
+			}
+		}
+		return tieBreakLess(a, b)
+	})
+	return sorted
+}
+
+// Returns the value of metric for ve as a JSON value, formatting timestamps according to
+// timeFormat.
+func viewMetricValue(metric string, ve *viewElm, timeFormat string) string {
+	if metric == "forks" {
+		return strconv.Itoa(ve.forks)
+	} else if metric == "last_updated" {
+		return formatViewTime(ve.updated, timeFormat)
+	} else if metric == "open_issues" {
+		return strconv.Itoa(ve.openIssues)
+	} else if metric == "stars" {
+		return strconv.Itoa(ve.stars)
+	} else if metric == "contributors" {
+		return strconv.Itoa(ve.contributors)
+	}
+	return ""
+}
+
+// Returns the change of metric for ve since prev, its element in the previous refresh, as a
+// JSON number. The change of last_updated is in seconds. Repos that weren't in the previous
+// refresh, whose prev is nil, have no change.
+func viewMetricDelta(metric string, ve *viewElm, prev *viewElm) string {
+	if prev == nil {
+		return "0"
+	}
+	if metric == "last_updated" {
+		return strconv.FormatInt(int64(ve.updated.Sub(prev.updated)/time.Second), 10)
+	}
+	// Larger values rank first, so the comparison is the difference of the values.
+	return strconv.Itoa(-compareViewMetric(metric, ve, prev))
+}
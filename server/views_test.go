@@ -0,0 +1,406 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Returns a refreshed server of the test repos with config, or the default config if nil.
+func newRefreshedServer(t *testing.T, config *Config) *Server {
+	return newRefreshedServerOf(t, kTestRepos, config)
+}
+
+// Serves a GET of path with the If-None-Match etag by s.
+func getIfNoneMatch(s *Server, path string, etag string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("If-None-Match", etag)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestViewsETag(t *testing.T) {
+	s := newRefreshedServer(t, nil)
+	etag := get(s, "/view/top/2/stars").Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("Got no ETag")
+	}
+	if w := getIfNoneMatch(s, "/view/top/2/stars", etag); w.Code != http.StatusNotModified {
+		t.Errorf("Got %v for a matching ETag, want 304", w.Code)
+	}
+	s.refreshCaches()
+	if w := getIfNoneMatch(s, "/view/top/2/stars", etag); w.Code != http.StatusOK {
+		t.Errorf("Got %v for the ETag of the previous refresh, want 200", w.Code)
+	}
+	// Another instance at the same generation may serve other rankings.
+	other := newRefreshedServer(t, nil)
+	if w := getIfNoneMatch(other, "/view/top/2/stars", etag); w.Code != http.StatusOK {
+		t.Errorf("Got %v for the ETag of another instance, want 200", w.Code)
+	}
+}
+
+// Views filtered by updated_within only rank the repos updated within the window, which
+// must be a positive number of days or duration, and have no ETag.
+func TestViewsUpdatedWithin(t *testing.T) {
+	updatedAt := func(age time.Duration) string {
+		return time.Now().Add(-age).UTC().Format(time.RFC3339)
+	}
+	fakeGitHub(t, fakeOrg(DefaultOrg, `[
+{"id":1,"name":"old","forks_count":3,"open_issues_count":1,"stargazers_count":10,
+ "updated_at":"`+updatedAt(400*24*time.Hour)+`"},
+{"id":2,"name":"new","forks_count":5,"open_issues_count":0,"stargazers_count":20,
+ "updated_at":"`+updatedAt(48*time.Hour)+`"}]`))
+	s := newTestServer(t, DefaultOrg, nil)
+	s.refreshCaches()
+	tests := []struct {
+		window string
+		status int
+		repos  string
+	}{
+		{"7d", http.StatusOK, `["Netflix/new"]`},
+		{"72h", http.StatusOK, `["Netflix/new"]`},
+		{"3650d", http.StatusOK, `["Netflix/new","Netflix/old"]`},
+		{"24h", http.StatusOK, `[]`},
+		{"0d", http.StatusBadRequest, ""},
+		{"-12h", http.StatusBadRequest, ""},
+		{"30x", http.StatusBadRequest, ""},
+		{"d", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		w := get(s, "/view/top/2/stars?updated_within="+test.window)
+		if w.Code != test.status {
+			t.Errorf("Got %v %v for %v, want %v", w.Code, w.Body.String(), test.window,
+				test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var rows [][]interface{}
+		json.Unmarshal(w.Body.Bytes(), &rows)
+		names := []string{}
+		for _, row := range rows {
+			names = append(names, row[0].(string))
+		}
+		if got, _ := json.Marshal(names); string(got) != test.repos {
+			t.Errorf("Got %v for %v, want %v", w.Body.String(), test.window, test.repos)
+		}
+		if etag := w.Header().Get("ETag"); etag != "" {
+			t.Errorf("Got ETag %v for %v, want none", etag, test.window)
+		}
+	}
+}
+
+func TestViewsDefaultBranch(t *testing.T) {
+	s := newRefreshedServer(t, nil)
+	w := get(s, "/view/top/2/stars?default_branch=true")
+	if want := `[["Netflix/b",20,"trunk"],["Netflix/a\"q",10,"main"]]`; w.Body.String() != want {
+		t.Errorf("Got %v, want %v", w.Body.String(), want)
+	}
+	if w := get(s, "/view/top/2/stars?default_branch=yes"); w.Code != http.StatusBadRequest {
+		t.Errorf("Got %v for an invalid default_branch, want 400", w.Code)
+	}
+}
+
+// The license filter matches the SPDX ID case insensitively.
+func TestViewsLicense(t *testing.T) {
+	s := newRefreshedServer(t, nil)
+	for _, test := range []struct {
+		license string
+		want    string
+	}{
+		{"apache-2.0", `[["Netflix/a\"q",10]]`},
+		{"Apache-2.0", `[["Netflix/a\"q",10]]`},
+		{"mit", `[]`},
+	} {
+		w := get(s, "/view/top/2/stars?license="+test.license)
+		if w.Code != http.StatusOK || w.Body.String() != test.want {
+			t.Errorf("Got %v %v for %v, want 200 %v", w.Code, w.Body.String(), test.license,
+				test.want)
+		}
+	}
+}
+
+// N=0 asks for no results, which is always an empty array with a 200.
+func TestViewsZeroN(t *testing.T) {
+	config := DefaultConfig()
+	config.EmptyViewStatus = http.StatusNoContent
+	s := newRefreshedServer(t, config)
+	for _, path := range []string{"/view/top/0/stars", "/view/top/0/stars?license=mit"} {
+		if w := get(s, path); w.Code != http.StatusOK || w.Body.String() != "[]" {
+			t.Errorf("Got %v %q for %v, want 200 []", w.Code, w.Body.String(), path)
+		}
+	}
+}
+
+// The repos are served along with the generation they belong to, even while refreshes
+// commit new generations.
+func TestReposGenerationConsistent(t *testing.T) {
+	var fetches atomic.Int32
+	fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repos := kTestRepos
+		if r.URL.Path == "/orgs/Netflix/repos" && fetches.Add(1)%2 == 0 {
+			repos = `[]`
+		}
+		fakeOrg(DefaultOrg, repos).ServeHTTP(w, r)
+	}))
+	s := newTestServer(t, DefaultOrg, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for run := 0; run < 20; run++ {
+			s.refreshOnce(s.reposPath, s.refreshNetflixRepos)
+		}
+	}()
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		w := get(s, s.reposPath)
+		generation, _ := strconv.Atoi(w.Header().Get("X-Cache-Generation"))
+		// Odd generations hold the repos, even ones none.
+		if generation > 0 && (generation%2 == 1) != strings.Contains(w.Body.String(), `"b"`) {
+			t.Fatalf("Got generation %v with %v", generation, w.Body)
+		}
+	}
+}
+
+// Disabled views get a 404 rather than being proxied to github.
+func TestViewsDisabled(t *testing.T) {
+	config := DefaultConfig()
+	config.EnableViews = false
+	s := newRefreshedServer(t, config)
+	for _, path := range []string{"/view/top/2/stars", "/view/topics", "/view/unknown"} {
+		w := get(s, path)
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "Views are disabled") {
+			t.Errorf("Got %v %v for %v, want 404", w.Code, w.Body.String(), path)
+		}
+		if age := w.Header().Get("X-Data-Age"); age != "" {
+			t.Errorf("Got X-Data-Age %v for %v, want none", age, path)
+		}
+	}
+}
+
+// Views are served from the last completed refresh without waiting on one in progress.
+func TestViewsServedDuringRefresh(t *testing.T) {
+	var blocking atomic.Bool
+	fetching, release := make(chan struct{}, 1), make(chan struct{})
+	fakeGitHub(t, blockingRepos(&blocking, fetching, release))
+	s := newTestServer(t, DefaultOrg, nil)
+	s.refreshCaches()
+	want := get(s, "/view/top/2/stars")
+	wantGeneration := want.Header().Get("X-Cache-Generation")
+	blocking.Store(true)
+	refreshed := make(chan struct{})
+	go func() {
+		s.refreshOnce(s.reposPath, s.refreshNetflixRepos)
+		close(refreshed)
+	}()
+	<-fetching
+	for run := 0; run < 10; run++ {
+		assertResponsive(t, s, "/view/top/2/stars")
+		w := get(s, "/view/top/2/stars")
+		if generation := w.Header().Get("X-Cache-Generation"); generation != wantGeneration ||
+			w.Body.String() != want.Body.String() {
+			t.Errorf("Got generation %v %v during the refresh, want generation %v %v",
+				generation, w.Body, wantGeneration, want.Body)
+		}
+	}
+	close(release)
+	<-refreshed
+	w := get(s, "/view/top/2/stars")
+	if generation := w.Header().Get("X-Cache-Generation"); generation == wantGeneration {
+		t.Errorf("Still serving generation %v after the refresh", generation)
+	}
+}
+
+// An N larger than the number of repos lists all of them.
+func TestViewsLargeN(t *testing.T) {
+	s := newRefreshedServer(t, nil)
+	for _, path := range []string{"/view/top/1000/stars", "/view/top/1000/last_updated",
+		"/view/top/2147483647/forks,stars"} {
+		w := get(s, path)
+		var rows [][]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &rows); w.Code != http.StatusOK || err != nil ||
+			len(rows) != 2 {
+			t.Errorf("Got %v %v for %v, want 200 with the 2 repos", w.Code, w.Body.String(), path)
+		}
+	}
+}
+
+// Deltas are the changes since the previous refresh, and zero for new repos.
+func TestViewsDeltas(t *testing.T) {
+	const repoA = `{"id":1,"name":"a","forks_count":3,"open_issues_count":1,` +
+		`"stargazers_count":%v,"updated_at":"2021-03-04T12:00:00Z"}`
+	var refreshed atomic.Bool
+	fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repos := "[" + fmt.Sprintf(repoA, 10) + "]"
+		if refreshed.Load() {
+			repos = "[" + fmt.Sprintf(repoA, 15) + `,{"id":2,"name":"b","forks_count":5,` +
+				`"open_issues_count":0,"stargazers_count":20,` +
+				`"updated_at":"2022-03-04T12:00:00Z"}]`
+		}
+		fakeOrg(DefaultOrg, repos).ServeHTTP(w, r)
+	}))
+	s := newTestServer(t, DefaultOrg, nil)
+	s.refreshCaches()
+	refreshed.Store(true)
+	s.refreshCaches()
+	w := get(s, "/view/top/2/stars,forks?deltas=true")
+	if want := `[["Netflix/b",20,5,0,0],["Netflix/a",15,3,5,0]]`; w.Code != http.StatusOK ||
+		w.Body.String() != want {
+		t.Errorf("Got %v %v, want 200 %v", w.Code, w.Body.String(), want)
+	}
+}
+
+// Malformed view paths get a 400 with a JSON error body.
+func TestViewsMalformedPaths(t *testing.T) {
+	s := newRefreshedServer(t, nil)
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"no metric", "/view/top/"},
+		{"no metric after N", "/view/top/10/"},
+		{"N not an integer", "/view/top/abc/stars"},
+		{"N overflowing", "/view/top/99999999999999999999/stars"},
+		{"unknown metric", "/view/top/10/bogus"},
+		{"unknown secondary metric", "/view/top/10/stars,bogus"},
+		{"empty metric", "/view/top/10/stars,"},
+		{"too many segments", "/view/top/10/stars/extra"},
+		{"invalid time_format", "/view/top/10/stars?time_format=iso"},
+		{"invalid deltas", "/view/top/10/stars?deltas=1"},
+	}
+	for _, test := range tests {
+		w := get(s, test.path)
+		var body struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); w.Code != http.StatusBadRequest ||
+			err != nil || body.Error == "" {
+			t.Errorf("%v: got %v %v, want 400 with a JSON error", test.name, w.Code,
+				w.Body.String())
+		}
+	}
+}
+
+// Repo names needing escaping, like a"q, are valid JSON in every view.
+func TestViewsEscapeNames(t *testing.T) {
+	s := newRefreshedServer(t, nil)
+	for _, path := range []string{"/view/top/2/stars", "/view/top/2/last_updated",
+		"/view/top/2/forks,open_issues?deltas=true", "/view/top/2/stars?qualified=false"} {
+		var rows [][]interface{}
+		if err := json.Unmarshal(get(s, path).Body.Bytes(), &rows); err != nil {
+			t.Errorf("Got invalid JSON for %v, err=%v", path, err)
+			continue
+		}
+		found := false
+		for _, row := range rows {
+			found = found || row[0] == `Netflix/a"q` || row[0] == `a"q`
+		}
+		if !found {
+			t.Errorf("Got %v for %v, want a row for a\"q", rows, path)
+		}
+	}
+}
+
+// The last_updated view emits RFC3339 timestamps in UTC.
+func TestViewsLastUpdatedRFC3339(t *testing.T) {
+	s := newRefreshedServer(t, nil)
+	var rows [][]string
+	if err := json.Unmarshal(get(s, "/view/top/2/last_updated").Body.Bytes(), &rows); err != nil {
+		t.Fatalf("Got invalid view, err=%v", err)
+	}
+	want := []string{"2022-03-04T12:00:00Z", "2021-03-04T12:00:00Z"}
+	for ii, row := range rows {
+		updated, err := time.Parse(time.RFC3339, row[1])
+		if err != nil {
+			t.Errorf("Got unparsable timestamp %q, err=%v", row[1], err)
+		} else if updated.UTC().Format(time.RFC3339) != row[1] || row[1] != want[ii] {
+			t.Errorf("Got timestamp %q, want %q", row[1], want[ii])
+		}
+	}
+}
+
+// The routes derived from the repos don't depend on which view metrics are precomputed.
+func TestViewMetricsSubset(t *testing.T) {
+	config := DefaultConfig()
+	config.ViewMetrics = []string{"open_issues"}
+	config.AdminSecret = kTestAdminSecret
+	s := newRefreshedServer(t, config)
+	if w := get(s, "/view/top/2/stars"); w.Code != http.StatusNotFound {
+		t.Errorf("Got %v for a disabled metric, want 404", w.Code)
+	}
+	for path, want := range map[string]string{
+		"/feed/updated":             "Netflix/b",
+		"/metrics":                  `repo_forks{repo="Netflix/b"} 5`,
+		"/orgs/Netflix?extras=true": `"total_stars":30`,
+	} {
+		if w := get(s, path); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Got %v %v for %v, want %v", w.Code, w.Body.String(), path, want)
+		}
+	}
+	// The diff reports changes of stars, even though they aren't precomputed.
+	fakeGitHub(t, fakeOrg(DefaultOrg, strings.Replace(kTestRepos, `"stargazers_count":20`,
+		`"stargazers_count":25`, 1)))
+	s.refreshCaches()
+	if w := getAdmin(s, "/admin/diff"); w.Header().Get("X-Total-Count") != "1" {
+		t.Errorf("Got %v %v for the diff, want the change of b", w.Code, w.Body.String())
+	}
+}
+
+// The diff reports the repos added, removed and changed by the latest refresh, and is
+// empty until there is a previous refresh to compare with.
+func TestAdminDiff(t *testing.T) {
+	config := DefaultConfig()
+	config.AdminSecret = kTestAdminSecret
+	s := newRefreshedServer(t, config)
+	w := getAdmin(s, "/admin/diff")
+	if want := `{"added":[],"removed":[],"changed":[]}`; w.Body.String() != want ||
+		w.Header().Get("X-Total-Count") != "0" {
+		t.Errorf("Got %v with X-Total-Count %v after the first refresh, want %v", w.Body.String(),
+			w.Header().Get("X-Total-Count"), want)
+	}
+	fakeGitHub(t, fakeOrg(DefaultOrg, `[
+{"id":2,"name":"b","forks_count":5,"open_issues_count":0,"stargazers_count":25,
+ "updated_at":"2022-03-04T12:00:00Z"},
+{"id":3,"name":"c","forks_count":0,"open_issues_count":0,"stargazers_count":1,
+ "updated_at":"2022-03-04T12:00:00Z"}]`))
+	s.refreshCaches()
+	w = getAdmin(s, "/admin/diff")
+	want := `{"added":["Netflix/c"],"removed":["Netflix/a\"q"],` +
+		`"changed":[{"repo":"Netflix/b","changes":{"stars":{"from":20,"to":25}}}]}`
+	if w.Body.String() != want || w.Header().Get("X-Total-Count") != "3" {
+		t.Errorf("Got %v with X-Total-Count %v, want %v", w.Body.String(),
+			w.Header().Get("X-Total-Count"), want)
+	}
+}
+
+// HTML views link to the repos on github, escaping names like a"q in the text and links.
+func TestViewsHTML(t *testing.T) {
+	s := newRefreshedServer(t, nil)
+	w := get(s, "/view/top/2/stars?format=html")
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Got Content-Type %v, want HTML", ct)
+	}
+	for _, want := range []string{
+		`<a href="https://github.com/Netflix/b">Netflix/b</a></td><td>20</td>`,
+		`<a href="https://github.com/Netflix/a%22q">Netflix/a&#34;q</a></td><td>10</td>`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Got %v, want it to contain %v", w.Body.String(), want)
+		}
+	}
+	if strings.Contains(w.Body.String(), `a"q`) {
+		t.Errorf("Got %v, want a\"q escaped", w.Body.String())
+	}
+}
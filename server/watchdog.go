@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"time"
+)
+
+// This file contains the refresh watchdog. If github blackholes our connections, the
+// refresh functions block forever and the caches silently go stale while /healthcheck keeps
+// reporting ready. The watchdog independently checks that the refreshes of every cache
+// keep completing, successfully or not, and flags the caches whose refreshes haven't for
+// Config.WatchdogIntervals intervals.
+
+// Period at which the watchdog checks the caches.
+const kWatchdogCheckPeriod = time.Minute
+
+// Loop forever, checking that the refreshes of every cache completed recently.
+func (s *Server) watchdogLoop(startedAt time.Time) {
+	for {
+		time.Sleep(kWatchdogCheckPeriod)
+		s.checkRefreshStall(startedAt, time.Now())
+	}
+}
+
+// Logs an error for every cache whose refreshes haven't completed in WatchdogIntervals
+// intervals as of now, and records whether any cache is stalled.
+func (s *Server) checkRefreshStall(startedAt time.Time, now time.Time) {
+	stalled := false
+	s.lock.Lock()
+	for path := range s.refreshFns {
+		// Caches whose refreshes never completed count from startup.
+		last, ok := s.completedAt[path]
+		if !ok {
+			last = startedAt
+		}
+		limit := time.Duration(s.config.WatchdogIntervals) * s.config.refreshIntervalFor(path)
+		if now.Sub(last) > limit {
+			slog.Error(fmt.Sprintf("No refresh of %v completed since %v, refresh loop may be stuck",
+				path, last.Format(time.RFC3339)))
+			stalled = true
+		}
+	}
+	if stalled != s.stalled {
+		if !stalled {
+			log.Printf("All caches are being refreshed again")
+		}
+		s.stalled = stalled
+	}
+	s.lock.Unlock()
+}